@@ -34,6 +34,16 @@ func NewAttributes() Attributes {
 // This method is the equivalent of assigning the value to a[key], with
 // added sanity checks.
 func (a Attributes) AddAttribute(key string, value interface{}) error {
+	if err := checkAttribute(key, value); err != nil {
+		return err
+	}
+	a[key] = value
+	return nil
+}
+
+// checkAttribute returns an error if the key is reserved by the JSON API or
+// if the type of the value is not marshalable by Go's JSON package.
+func checkAttribute(key string, value interface{}) error {
 	err := isValidJSONValue(reflect.ValueOf(value))
 	if err != nil {
 		return err
@@ -41,7 +51,6 @@ func (a Attributes) AddAttribute(key string, value interface{}) error {
 	if key == "relationships" || key == "links" {
 		return ErrAttributeInvalidKey
 	}
-	a[key] = value
 	return nil
 }
 
@@ -0,0 +1,256 @@
+// Package client implements an HTTP client for
+// <a href="http://jsonapi.org/">JSON API</a> services, marshaling and
+// unmarshaling tagged structs with the tjsonapi package.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strconv"
+
+	"github.com/empara/tjsonapi"
+)
+
+var (
+	// ErrUnexpectedContentType is an error object returned when a response
+	// holding a body doesn't have the JSON API media type.
+	ErrUnexpectedContentType = errors.New("Response is not a JSON API document")
+
+	// ErrBadRequest is matched by the response errors with a 400 status code.
+	ErrBadRequest = errors.New("Bad request")
+	// ErrUnauthorized is matched by the response errors with a 401 status
+	// code.
+	ErrUnauthorized = errors.New("Unauthorized")
+	// ErrForbidden is matched by the response errors with a 403 status code.
+	ErrForbidden = errors.New("Forbidden")
+	// ErrNotFound is matched by the response errors with a 404 status code.
+	ErrNotFound = errors.New("Not found")
+	// ErrConflict is matched by the response errors with a 409 status code.
+	ErrConflict = errors.New("Conflict")
+	// ErrUnprocessable is matched by the response errors with a 422 status
+	// code.
+	ErrUnprocessable = errors.New("Unprocessable entity")
+	// ErrServer is matched by the response errors with a 5xx status code.
+	ErrServer = errors.New("Server error")
+)
+
+// statusErrors maps status codes to the errors matched by response errors.
+var statusErrors = map[int]error{
+	http.StatusBadRequest:          ErrBadRequest,
+	http.StatusUnauthorized:        ErrUnauthorized,
+	http.StatusForbidden:           ErrForbidden,
+	http.StatusNotFound:            ErrNotFound,
+	http.StatusConflict:            ErrConflict,
+	http.StatusUnprocessableEntity: ErrUnprocessable,
+}
+
+// ResponseError is an error type returned when a server answers with an
+// error status code. Errors holds the error objects of the response, if it
+// was an error document.
+// A ResponseError matches the error of its status code with errors.Is, such
+// as ErrNotFound, and its error objects with errors.As.
+type ResponseError struct {
+	StatusCode int
+	Errors     tjsonapi.Errors
+}
+
+// Error returns the messages of the error objects, or the status code if the
+// response held none.
+func (e *ResponseError) Error() string {
+	if len(e.Errors) > 0 {
+		return e.Errors.Error()
+	}
+	return strconv.Itoa(e.StatusCode) + " " + http.StatusText(e.StatusCode)
+}
+
+// Is returns whether or not target is the error of the status code of the
+// response.
+func (e *ResponseError) Is(target error) bool {
+	if e.StatusCode >= 500 {
+		return target == ErrServer
+	}
+	return statusErrors[e.StatusCode] == target
+}
+
+// Unwrap returns the error objects of the response.
+func (e *ResponseError) Unwrap() []error {
+	return e.Errors.Unwrap()
+}
+
+// Client is a struct sending requests to JSON API services. Documents are
+// marshaled and unmarshaled with Context, and Header holds headers added to
+// every request.
+type Client struct {
+	HTTPClient *http.Client
+	Context    *tjsonapi.Context
+	Header     http.Header
+}
+
+// New allocates and initializes a new Client object, using
+// http.DefaultClient and a new Context.
+func New() *Client {
+	return &Client{
+		HTTPClient: http.DefaultClient,
+		Context:    tjsonapi.NewContext(),
+		Header:     make(http.Header),
+	}
+}
+
+// Get fetches the resource or the collection at rawURL and unmarshals it to
+// v, which must be a pointer to a struct or to a slice of structs.
+func (c *Client) Get(ctx context.Context, rawURL string, v interface{},
+	opts ...Option) error {
+	_, err := c.Do(ctx, http.MethodGet, rawURL, nil, v, opts...)
+	return err
+}
+
+// Create sends the resource v to the collection at rawURL, and unmarshals
+// the created resource returned by the server to v. The identifier of v is
+// only sent if it isn't the zero value, so that the server generates it
+// otherwise.
+func (c *Client) Create(ctx context.Context, rawURL string, v interface{},
+	opts ...Option) error {
+	root, err := c.Context.Marshal(v)
+	if err != nil {
+		return err
+	}
+	c.omitZeroID(root, v)
+	_, err = c.Do(ctx, http.MethodPost, rawURL, root, v, opts...)
+	return err
+}
+
+// Update sends the resource v to rawURL, and unmarshals the updated
+// resource returned by the server to v, if any.
+func (c *Client) Update(ctx context.Context, rawURL string, v interface{},
+	opts ...Option) error {
+	_, err := c.Do(ctx, http.MethodPatch, rawURL, v, v, opts...)
+	return err
+}
+
+// Delete deletes the resource at rawURL.
+func (c *Client) Delete(ctx context.Context, rawURL string,
+	opts ...Option) error {
+	_, err := c.Do(ctx, http.MethodDelete, rawURL, nil, nil, opts...)
+	return err
+}
+
+// Do sends a request with the given method to rawURL, with the options
+// applied. If in is not nil, it is marshaled as the body of the request,
+// unless it is already a *tjsonapi.Root. If
+// out is not nil and the response has primary data, it is unmarshaled to
+// out. The document of the response is returned, or nil if it has no body.
+// Error statuses are returned as a *ResponseError.
+func (c *Client) Do(ctx context.Context, method, rawURL string, in,
+	out interface{}, opts ...Option) (*tjsonapi.Root, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	query := u.Query()
+	header := c.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	for _, opt := range opts {
+		opt(query, header)
+	}
+	u.RawQuery = query.Encode()
+
+	var body io.Reader
+	if in != nil {
+		root, isRoot := in.(*tjsonapi.Root)
+		if !isRoot {
+			if root, err = c.Context.Marshal(in); err != nil {
+				return nil, err
+			}
+		}
+		data, err := json.Marshal(root)
+		if err != nil {
+			return nil, err
+		}
+		body = bytes.NewReader(data)
+		header.Set("Content-Type", tjsonapi.MediaType)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = header
+	if req.Header.Get("Accept") == "" {
+		req.Header.Set("Accept", tjsonapi.MediaType)
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	root, err := c.readResponse(resp)
+	if err != nil {
+		return nil, err
+	}
+	if out != nil && root != nil && root.Data != nil {
+		if err := c.Context.Unmarshal(root, out); err != nil {
+			return root, err
+		}
+	}
+	return root, nil
+}
+
+// omitZeroID removes the identifier of the resource marshaled from v to root
+// if it is the identifier of the zero value of v, such as "0" or "".
+func (c *Client) omitZeroID(root *tjsonapi.Root, v interface{}) {
+	if root.Data == nil || root.Data.Type != tjsonapi.ResourcesOne ||
+		len(root.Data.Data) != 1 || root.Data.Data[0] == nil {
+		return
+	}
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	zero, err := c.Context.Marshal(reflect.New(t).Interface())
+	if err != nil || zero.Data == nil || len(zero.Data.Data) != 1 ||
+		zero.Data.Data[0] == nil {
+		return
+	}
+	if zero.Data.Data[0].ID == root.Data.Data[0].ID {
+		root.Data.Data[0].ID = ""
+	}
+}
+
+// readResponse reads the document of a response, returning a ResponseError
+// for error status codes. Non-empty bodies are only decoded if they are
+// given the JSON API media type.
+func (c *Client) readResponse(resp *http.Response) (*tjsonapi.Root, error) {
+	var root *tjsonapi.Root
+	var err error
+	if resp.StatusCode != http.StatusNoContent {
+		body := bufio.NewReader(resp.Body)
+		if _, err = body.Peek(1); errors.Is(err, io.EOF) {
+			err = nil
+		} else if err == nil {
+			_, err = tjsonapi.ParseMediaType(resp.Header.Get("Content-Type"))
+			if err != nil {
+				err = ErrUnexpectedContentType
+			} else {
+				root, err = c.Context.NewDecoder(body).DecodeRoot()
+			}
+		}
+	}
+
+	if resp.StatusCode >= 400 {
+		respErr := &ResponseError{StatusCode: resp.StatusCode}
+		if err == nil && root != nil {
+			respErr.Errors = root.Errors
+		}
+		return nil, respErr
+	}
+	return root, err
+}
@@ -0,0 +1,395 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/empara/tjsonapi"
+)
+
+type testPerson struct {
+	ID   int    `jsonapi:"identifier,people"`
+	Name string `jsonapi:"attribute,name"`
+}
+
+// testPeopleHandler is an in-memory ResourceHandler of people, recording the
+// last request it received and its body.
+type testPeopleHandler struct {
+	people  map[int]testPerson
+	nextID  int
+	request *http.Request
+	body    []byte
+}
+
+func (h *testPeopleHandler) FindAll(r *http.Request,
+	q *tjsonapi.Query) (interface{}, error) {
+	h.request = r
+	people := make([]testPerson, 0, len(h.people))
+	for _, person := range h.people {
+		if name := q.Filter.Get("name"); name == "" || name == person.Name {
+			people = append(people, person)
+		}
+	}
+	sort.Slice(people, func(i, j int) bool {
+		return people[i].ID < people[j].ID
+	})
+	return people, nil
+}
+
+func (h *testPeopleHandler) FindOne(r *http.Request, id string,
+	q *tjsonapi.Query) (interface{}, error) {
+	h.request = r
+	key, _ := strconv.Atoi(id)
+	person, found := h.people[key]
+	if !found {
+		return nil, nil
+	}
+	return &person, nil
+}
+
+func (h *testPeopleHandler) Create(r *http.Request,
+	v interface{}) (interface{}, error) {
+	h.request = r
+	person := v.(*testPerson)
+	h.nextID++
+	person.ID = h.nextID
+	h.people[person.ID] = *person
+	return person, nil
+}
+
+func (h *testPeopleHandler) Update(r *http.Request, id string,
+	v interface{}) (interface{}, error) {
+	h.request = r
+	person := v.(*testPerson)
+	if _, found := h.people[person.ID]; !found {
+		return nil, tjsonapi.ErrResourceNotFound
+	}
+	person.Name += "!"
+	h.people[person.ID] = *person
+	return person, nil
+}
+
+func (h *testPeopleHandler) Delete(r *http.Request, id string) error {
+	h.request = r
+	key, _ := strconv.Atoi(id)
+	if _, found := h.people[key]; !found {
+		return tjsonapi.ErrResourceNotFound
+	}
+	delete(h.people, key)
+	return nil
+}
+
+func newTestServer(t *testing.T) (*httptest.Server, *testPeopleHandler) {
+	handler := &testPeopleHandler{people: map[int]testPerson{
+		1: {ID: 1, Name: "Dan"},
+		2: {ID: 2, Name: "Eve"},
+	}, nextID: 2}
+	router := tjsonapi.NewRouter()
+	if err := router.Register(testPerson{}, handler); err != nil {
+		t.Fatal("Error while registering handler:", err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			handler.body, _ = io.ReadAll(r.Body)
+			r.Body = io.NopCloser(bytes.NewReader(handler.body))
+			tjsonapi.Negotiate(router).ServeHTTP(w, r)
+		}))
+	t.Cleanup(server.Close)
+	return server, handler
+}
+
+func TestClient(t *testing.T) {
+	server, handler := newTestServer(t)
+	c := New()
+	ctx := context.Background()
+
+	var people []testPerson
+	err := c.Get(ctx, server.URL+"/people", &people, Filter("Eve", "name"),
+		Filter("Dan"), Sort("-name"), Fields("people", "name"),
+		Page(tjsonapi.Page{Number: 1, Size: 10}), Header("X-Test", "yes"))
+	if err != nil {
+		t.Fatal("Error while fetching collection:", err)
+	}
+	if len(people) != 1 || people[0] != (testPerson{ID: 2, Name: "Eve"}) {
+		t.Error("Wrong collection:", people)
+	}
+	query := handler.request.URL.Query()
+	if query.Get("filter[name]") != "Eve" || query.Get("sort") != "-name" ||
+		query.Get("fields[people]") != "name" ||
+		query.Get("page[number]") != "1" || query.Get("page[size]") != "10" ||
+		len(query) != 5 {
+		t.Error("Wrong query parameters:", query)
+	}
+	if handler.request.Header.Get("Accept") != tjsonapi.MediaType ||
+		handler.request.Header.Get("X-Test") != "yes" {
+		t.Error("Wrong request headers:", handler.request.Header)
+	}
+
+	var person testPerson
+	if err := c.Get(ctx, server.URL+"/people/1", &person); err != nil {
+		t.Fatal("Error while fetching resource:", err)
+	}
+	if person != (testPerson{ID: 1, Name: "Dan"}) {
+		t.Error("Wrong resource:", person)
+	}
+
+	person = testPerson{Name: "Zoe"}
+	if err := c.Create(ctx, server.URL+"/people", &person); err != nil {
+		t.Fatal("Error while creating resource:", err)
+	}
+	if person.ID != 3 || handler.people[3].Name != "Zoe" {
+		t.Error("Wrong created resource:", person)
+	}
+	if handler.request.Header.Get("Content-Type") != tjsonapi.MediaType {
+		t.Error("Wrong request Content-Type:",
+			handler.request.Header.Get("Content-Type"))
+	}
+	var created struct {
+		Data map[string]interface{} `json:"data"`
+	}
+	json.Unmarshal(handler.body, &created)
+	if _, hasID := created.Data["id"]; hasID || created.Data["type"] != "people" {
+		t.Error("Zero identifier should not be sent:", string(handler.body))
+	}
+
+	person.Name = "Zed"
+	if err := c.Update(ctx, server.URL+"/people/3", &person); err != nil {
+		t.Fatal("Error while updating resource:", err)
+	}
+	if person.Name != "Zed!" {
+		t.Error("Updated resource not unmarshaled:", person)
+	}
+
+	if err := c.Delete(ctx, server.URL+"/people/3"); err != nil {
+		t.Fatal("Error while deleting resource:", err)
+	}
+	if _, found := handler.people[3]; found {
+		t.Error("Resource not deleted")
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	server, _ := newTestServer(t)
+	c := New()
+	ctx := context.Background()
+
+	var person testPerson
+	err := c.Get(ctx, server.URL+"/people/7", &person)
+	var respErr *ResponseError
+	if !errors.As(err, &respErr) || respErr.StatusCode != http.StatusNotFound {
+		t.Fatal("Wrong error for missing resource:", err)
+	}
+	if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrConflict) {
+		t.Error("Wrong status error matched:", err)
+	}
+	var object *tjsonapi.Error
+	if !errors.As(err, &object) || object.Status != "404" {
+		t.Error("Error objects not unwrapped:", respErr.Errors)
+	}
+
+	err = c.Delete(ctx, server.URL+"/people/7", Header("Accept", "text/html"))
+	if !errors.As(err, &respErr) ||
+		respErr.StatusCode != http.StatusNotAcceptable {
+		t.Error("Wrong status for unacceptable request:", err)
+	}
+
+	plain := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/html" {
+				w.Header().Set("Content-Type", "text/html")
+				w.WriteHeader(http.StatusBadGateway)
+				w.Write([]byte(`<html><body>Bad Gateway</body></html>`))
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Write([]byte(`{"data":null}`))
+		}))
+	defer plain.Close()
+	if err := c.Get(ctx, plain.URL, &person); err != ErrUnexpectedContentType {
+		t.Error("Wrong error for unexpected Content-Type:", err)
+	}
+	err = c.Get(ctx, plain.URL+"/html", &person)
+	if !errors.Is(err, ErrServer) || !errors.As(err, &respErr) ||
+		len(respErr.Errors) != 0 {
+		t.Error("Wrong error for HTML error response:", err)
+	}
+
+	failing := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+	defer failing.Close()
+	err = c.Get(ctx, failing.URL, &person)
+	if !errors.Is(err, ErrServer) || !errors.As(err, &respErr) ||
+		len(respErr.Errors) != 0 {
+		t.Error("Wrong error for empty error response:", err)
+	}
+}
+
+// newTestPagesServer returns a server paginating five people by number, two
+// per page, and the list of the URLs it received.
+func newTestPagesServer(t *testing.T) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			requests = append(requests, r.URL.String()+" "+r.Header.Get("X-Test"))
+			mu.Unlock()
+			q, err := tjsonapi.ParseQuery(r.URL.Query())
+			if err != nil {
+				tjsonapi.WriteErrors(w, err)
+				return
+			}
+			people := make([]testPerson, 0)
+			for id := (q.Page.Number-1)*q.Page.Size + 1; id <= 5 &&
+				len(people) < q.Page.Size; id++ {
+				people = append(people, testPerson{ID: id})
+			}
+			c := tjsonapi.NewContext()
+			c.Pagination = tjsonapi.NewPagination(r.URL, q.Page)
+			c.Pagination.SetTotal(5)
+			c.WriteData(w, http.StatusOK, people)
+		}))
+	t.Cleanup(server.Close)
+	return server, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), requests...)
+	}
+}
+
+func TestIterator(t *testing.T) {
+	for _, prefetch := range []bool{false, true} {
+		server, requests := newTestPagesServer(t)
+		var people []testPerson
+		it := New().Pages(context.Background(), server.URL+"/people", &people,
+			Page(tjsonapi.Page{Number: 1, Size: 2}), Header("X-Test", "yes"))
+		it.Prefetch = prefetch
+		var ids []int
+		pages := 0
+		for it.Next() {
+			pages++
+			for _, person := range people {
+				ids = append(ids, person.ID)
+			}
+		}
+		if err := it.Err(); err != nil {
+			t.Fatal("Error while iterating:", err)
+		}
+		if pages != 3 || !reflect.DeepEqual(ids, []int{1, 2, 3, 4, 5}) {
+			t.Error("Wrong pages:", pages, ids)
+		}
+		if it.Total() != 5 {
+			t.Error("Wrong total:", it.Total())
+		}
+		expected := []string{
+			"/people?page%5Bnumber%5D=1&page%5Bsize%5D=2 yes",
+			"/people?page%5Bnumber%5D=2&page%5Bsize%5D=2 yes",
+			"/people?page%5Bnumber%5D=3&page%5Bsize%5D=2 yes",
+		}
+		if !reflect.DeepEqual(requests(), expected) {
+			t.Error("Wrong requests:", prefetch, requests())
+		}
+	}
+}
+
+func TestIteratorCancel(t *testing.T) {
+	server, _ := newTestPagesServer(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	var people []testPerson
+	it := New().Pages(ctx, server.URL+"/people", &people,
+		Page(tjsonapi.Page{Number: 1, Size: 2}))
+	it.Prefetch = true
+	if !it.Next() {
+		t.Fatal("Error while fetching first page:", it.Err())
+	}
+	cancel()
+	if it.Next() || !errors.Is(it.Err(), context.Canceled) {
+		t.Error("Cancellation not reported:", it.Err())
+	}
+	if !reflect.DeepEqual(people, []testPerson{{ID: 1}, {ID: 2}}) {
+		t.Error("Page overwritten after cancellation:", people)
+	}
+
+	var person testPerson
+	it = New().Pages(context.Background(), server.URL, &person)
+	if it.Next() || it.Err() != ErrPageNotSlice {
+		t.Error("Wrong error for invalid page type:", it.Err())
+	}
+}
+
+func TestIteratorLinkObjects(t *testing.T) {
+	pages := map[string]string{
+		"1": `{"data":[{"type":"people","id":"1"}],` +
+			`"links":{"next":{"href":"/people?page=2","meta":{}}}}`,
+		"2": `{"data":[{"type":"people","id":"2"}],` +
+			`"links":{"next":{"href":"/people?page=3"}},"meta":{"total":3}}`,
+		"3": `{"data":[{"type":"people","id":"3"}],` +
+			`"links":{"next":{"href":12}}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			page := r.URL.Query().Get("page")
+			if page == "" {
+				page = "1"
+			}
+			w.Header().Set("Content-Type", tjsonapi.MediaType)
+			w.Write([]byte(pages[page]))
+		}))
+	defer server.Close()
+
+	var people []testPerson
+	it := New().Pages(context.Background(), server.URL+"/people", &people)
+	var ids []int
+	for it.Next() {
+		for _, person := range people {
+			ids = append(ids, person.ID)
+		}
+	}
+	if !reflect.DeepEqual(ids, []int{1, 2, 3}) || it.Total() != 3 {
+		t.Error("Link objects not followed:", ids, it.Total())
+	}
+	if !errors.Is(it.Err(), ErrMalformedLink) {
+		t.Error("Malformed next link not reported:", it.Err())
+	}
+}
+
+func TestIteratorCycle(t *testing.T) {
+	pages := map[string]string{
+		"1": `{"data":[{"type":"people","id":"1"}],` +
+			`"links":{"next":"/people?page=2"}}`,
+		"2": `{"data":[{"type":"people","id":"2"}],` +
+			`"links":{"next":"/people?page=1"}}`,
+	}
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", tjsonapi.MediaType)
+			w.Write([]byte(pages[r.URL.Query().Get("page")]))
+		}))
+	defer server.Close()
+
+	var people []testPerson
+	it := New().Pages(context.Background(), server.URL+"/people?page=1",
+		&people)
+	var ids []int
+	for it.Next() {
+		for _, person := range people {
+			ids = append(ids, person.ID)
+		}
+	}
+	if !reflect.DeepEqual(ids, []int{1, 2}) ||
+		!errors.Is(it.Err(), ErrPageCycle) {
+		t.Error("Cycle of next links not stopped:", ids, it.Err())
+	}
+}
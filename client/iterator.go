@@ -0,0 +1,242 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+
+	"github.com/empara/tjsonapi"
+)
+
+var (
+	// ErrPageNotSlice is an error object returned when an Iterator is
+	// created with something else than a pointer to a slice.
+	ErrPageNotSlice = errors.New("Pages must be unmarshaled to a pointer " +
+		"to a slice")
+
+	// ErrMalformedLink is an error object returned when the next link of a
+	// page is neither a string nor a link object with a string href.
+	ErrMalformedLink = errors.New("Malformed next link")
+
+	// ErrPageCycle is an error object returned when the next link of a page
+	// leads to a page that was already fetched.
+	ErrPageCycle = errors.New("Next link leads to a page already fetched")
+)
+
+// page is the result of fetching a page of a collection.
+type page struct {
+	URL  string
+	Data reflect.Value
+	Root *tjsonapi.Root
+	Err  error
+}
+
+// Iterator is a struct iterating over the pages of a collection, following
+// the <a href="http://jsonapi.org/format/#fetching-pagination">next
+// links</a> of the documents until there are none.
+// If Prefetch is set, the next page is fetched concurrently while the current
+// one is handled. TotalMeta is the key of the meta member holding the total
+// number of resources of the collection.
+type Iterator struct {
+	Prefetch  bool
+	TotalMeta string
+
+	client  *Client
+	ctx     context.Context
+	cancel  context.CancelFunc
+	slice   reflect.Value
+	first   []Option
+	opts    []Option
+	next    string
+	visited map[string]bool
+	total   int
+	pending chan *page
+	err     error
+}
+
+// Pages returns an Iterator over the pages of the collection at rawURL,
+// fetched with the given options. Each call to Next unmarshals a page to v,
+// which must be a pointer to a slice of structs. Query options only apply to
+// the first page, as next links already hold the query parameters of the
+// following pages.
+func (c *Client) Pages(ctx context.Context, rawURL string, v interface{},
+	opts ...Option) *Iterator {
+	ctx, cancel := context.WithCancel(ctx)
+	it := &Iterator{
+		TotalMeta: "total",
+		client:    c,
+		ctx:       ctx,
+		cancel:    cancel,
+		first:     opts,
+		opts:      headerOptions(opts),
+		next:      rawURL,
+		visited:   make(map[string]bool),
+		total:     -1,
+	}
+	slice := reflect.ValueOf(v)
+	if slice.Kind() != reflect.Ptr || slice.IsNil() ||
+		slice.Elem().Kind() != reflect.Slice {
+		it.err = ErrPageNotSlice
+		return it
+	}
+	it.slice = slice.Elem()
+	return it
+}
+
+// Next fetches the next page and unmarshals it, returning false once there
+// are no more pages, the context is done or an error occurred. A page whose
+// next link is malformed is still returned, the error stopping the iteration
+// at the following call, as is a next link leading to a page already
+// fetched.
+func (it *Iterator) Next() bool {
+	if it.err != nil || it.next == "" {
+		it.Close()
+		return false
+	}
+	if err := it.ctx.Err(); err != nil {
+		it.err = err
+		it.Close()
+		return false
+	}
+
+	var p *page
+	if it.pending != nil {
+		select {
+		case p = <-it.pending:
+		case <-it.ctx.Done():
+			it.err = it.ctx.Err()
+			it.Close()
+			return false
+		}
+		it.pending = nil
+	} else {
+		opts := it.opts
+		if it.first != nil {
+			opts, it.first = it.first, nil
+		}
+		p = it.fetch(it.next, opts)
+	}
+	if p.Err != nil {
+		it.err = p.Err
+		it.Close()
+		return false
+	}
+
+	it.slice.Set(p.Data)
+	it.visited[p.URL] = true
+	it.next, it.err = nextLink(p)
+	if it.visited[it.next] {
+		it.next, it.err = "", ErrPageCycle
+	}
+	if total, ok := metaInt(p.Root.Meta[it.TotalMeta]); ok {
+		it.total = total
+	}
+	if it.Prefetch && it.next != "" {
+		pending := make(chan *page, 1)
+		go func(rawURL string) {
+			pending <- it.fetch(rawURL, it.opts)
+		}(it.next)
+		it.pending = pending
+	}
+	return true
+}
+
+// Total returns the total number of resources found in the meta object of
+// the last page, or -1 if it's unknown.
+func (it *Iterator) Total() int {
+	return it.total
+}
+
+// Err returns the error that stopped the iteration, if any.
+func (it *Iterator) Err() error {
+	return it.err
+}
+
+// Close stops the iteration, cancelling the prefetching of the next page.
+func (it *Iterator) Close() {
+	it.cancel()
+	it.next = ""
+}
+
+// fetch fetches and unmarshals the page at rawURL.
+func (it *Iterator) fetch(rawURL string, opts []Option) *page {
+	p := &page{URL: rawURL}
+	data := reflect.New(it.slice.Type())
+	p.Root, p.Err = it.client.Do(it.ctx, http.MethodGet, rawURL, nil,
+		data.Interface(), opts...)
+	if p.Err == nil && p.Root == nil {
+		p.Err = ErrUnexpectedContentType
+	}
+	p.Data = data.Elem()
+	return p
+}
+
+// nextLink returns the next link of a page resolved against its URL, or an
+// empty string if there is none or if it points to the page itself. The link
+// may be a string or a link object, as decoded from JSON.
+func nextLink(p *page) (string, error) {
+	var next string
+	switch link := p.Root.Links[tjsonapi.LinkNext].(type) {
+	case nil:
+		return "", nil
+	case string:
+		next = link
+	case *tjsonapi.Link:
+		next = link.HRef
+	case map[string]interface{}:
+		href, ok := link["href"].(string)
+		if !ok {
+			return "", ErrMalformedLink
+		}
+		next = href
+	default:
+		return "", ErrMalformedLink
+	}
+	if next == "" {
+		return "", nil
+	}
+
+	base, err := url.Parse(p.URL)
+	if err != nil {
+		return "", err
+	}
+	ref, err := url.Parse(next)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", ErrMalformedLink, err)
+	}
+	next = base.ResolveReference(ref).String()
+	if next == base.String() {
+		return "", nil
+	}
+	return next, nil
+}
+
+// headerOptions returns options applying only the headers of opts.
+func headerOptions(opts []Option) []Option {
+	headers := make([]Option, len(opts))
+	for it, opt := range opts {
+		opt := opt
+		headers[it] = func(query url.Values, header http.Header) {
+			opt(make(url.Values), header)
+		}
+	}
+	return headers
+}
+
+// metaInt converts a meta value decoded from JSON to an int.
+func metaInt(v interface{}) (int, bool) {
+	switch n := v.(type) {
+	case float64:
+		return int(n), true
+	case json.Number:
+		i, err := n.Int64()
+		return int(i), err == nil
+	case int:
+		return n, true
+	}
+	return 0, false
+}
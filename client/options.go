@@ -0,0 +1,88 @@
+package client
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/empara/tjsonapi"
+)
+
+// Option is a function configuring the query parameters and the headers of
+// a request.
+type Option func(query url.Values, header http.Header)
+
+// Include requests the resources related through the given relationship
+// paths, such as "comments.author", to be included.
+func Include(paths ...string) Option {
+	return func(query url.Values, header http.Header) {
+		query.Set(tjsonapi.QueryInclude, strings.Join(paths, ","))
+	}
+}
+
+// Fields requests the resources of the given type to only hold the given
+// attributes and relationships.
+func Fields(typ string, fields ...string) Option {
+	return func(query url.Values, header http.Header) {
+		query.Set(tjsonapi.QueryFields+"["+typ+"]", strings.Join(fields, ","))
+	}
+}
+
+// Sort requests the resources to be sorted by the given fields, prefixed
+// with a minus sign for a descending order.
+func Sort(fields ...string) Option {
+	return func(query url.Values, header http.Header) {
+		query.Set(tjsonapi.QuerySort, strings.Join(fields, ","))
+	}
+}
+
+// Filter adds a filter parameter whose names are given by path, such as
+// Filter("Dan", "author", "name") for filter[author][name]=Dan. Filters
+// without a path are ignored.
+func Filter(value string, path ...string) Option {
+	return func(query url.Values, header http.Header) {
+		if len(path) == 0 {
+			return
+		}
+		query.Add(tjsonapi.QueryFilter+"["+strings.Join(path, "][")+"]", value)
+	}
+}
+
+// Page sets the page parameters of the request that are not zero.
+func Page(page tjsonapi.Page) Option {
+	return func(query url.Values, header http.Header) {
+		params := []struct {
+			name  string
+			value int
+		}{
+			{"number", page.Number},
+			{"size", page.Size},
+			{"offset", page.Offset},
+			{"limit", page.Limit},
+		}
+		for _, param := range params {
+			if param.value != 0 {
+				query.Set(tjsonapi.QueryPage+"["+param.name+"]",
+					strconv.Itoa(param.value))
+			}
+		}
+		if page.Cursor != "" {
+			query.Set(tjsonapi.QueryPage+"[cursor]", page.Cursor)
+		}
+	}
+}
+
+// Param sets a query parameter, such as those of extensions.
+func Param(name, value string) Option {
+	return func(query url.Values, header http.Header) {
+		query.Set(name, value)
+	}
+}
+
+// Header sets a header of the request.
+func Header(name, value string) Option {
+	return func(query url.Values, header http.Header) {
+		header.Set(name, value)
+	}
+}
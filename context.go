@@ -10,9 +10,39 @@ var (
 
 // Context is a struct allowing the user to add links and relationships models
 // to use with the `jsonapi:"...,context"` tag.
+// The JSONAPI, DocumentLinks and DocumentMeta members are copied to the
+// top-level document when marshaling.
+// When Strict is true, unmarshaling fails on values that can't be parsed, on
+// values whose JSON type doesn't match the type of the struct member, and on
+// attributes and relationships that aren't mapped by any struct member.
+// When CollectErrors is true, marshaling and unmarshaling don't stop at the
+// first error, but return every error found as an ErrorList.
+// When UseNumber is true, the Decoders of the Context and DecodeRequest
+// decode numbers as json.Number instead of float64, so that large integers
+// don't lose precision.
+// Fieldsets restricts the attributes and relationships of the marshaled
+// resources, per type, and Include restricts the embedded relationships
+// whose resources are included, every one being included when it is nil.
+// Pagination adds pagination links to the documents of collections.
+// MaxBodySize limits the size of the request bodies read by DecodeRequest,
+// DefaultMaxBodySize being used when it is zero.
 type Context struct {
 	Relationships Relationships
 	Links         map[string]*Link
+
+	JSONAPI       *JSONAPI
+	DocumentLinks Links
+	DocumentMeta  Meta
+
+	Fieldsets  Fieldsets
+	Include    Includes
+	Pagination *Pagination
+
+	Strict        bool
+	CollectErrors bool
+	UseNumber     bool
+
+	MaxBodySize int64
 }
 
 // NewContext allocates and initializes a new Context object and returns it.
@@ -20,5 +50,7 @@ func NewContext() *Context {
 	return &Context{
 		Relationships: NewRelationships(),
 		Links:         make(map[string]*Link),
+		DocumentLinks: NewLinks(),
+		DocumentMeta:  NewMeta(),
 	}
 }
@@ -1,8 +1,12 @@
 package tjsonapi
 
 import (
+	"bytes"
 	"encoding"
+	"encoding/json"
 	"errors"
+	"fmt"
+	"math"
 	"reflect"
 	"strconv"
 	"strings"
@@ -28,8 +32,97 @@ var (
 	// ErrCantSet is an error object that is returned when a value can't be
 	// set to another.
 	ErrCantSet = errors.New("Can't set")
+
+	// ErrDecodingInvalidValue is an error object that is returned when a
+	// string can't be parsed to the type of the value it is decoded to.
+	// Unless the Context is strict, these errors are ignored and the value
+	// is set to the zero value of its type.
+	ErrDecodingInvalidValue = errors.New("Value can't be parsed")
+
+	// ErrDecodingUnknownMember is an error object that is returned by strict
+	// contexts when an attribute or a relationship of the decoded resource
+	// isn't mapped to any member of the struct.
+	ErrDecodingUnknownMember = errors.New("Unknown member")
+
+	// ErrDecodingOverflow is an error object that is returned when a number
+	// doesn't fit in the type of the value it is decoded to.
+	ErrDecodingOverflow = errors.New("Number overflows value type")
+
+	// ErrDecodingNoData is an error object that is returned when the root
+	// to unmarshal has neither a data member nor an errors member.
+	ErrDecodingNoData = errors.New("Root has no primary data")
+
+	// ErrDecodingMalformed is an error object that is returned when a
+	// streamed document doesn't have the structure of a JSON API document.
+	ErrDecodingMalformed = errors.New("Malformed JSONAPI document")
 )
 
+// DecodeError is an error type describing where and why a JSON API document
+// failed to unmarshal. It wraps the underlying error, so errors.Is can still
+// be used with the Err* values of this package.
+type DecodeError struct {
+	// Pointer is the JSON Pointer to the member of the document that failed
+	// to decode (e.g. "/data/1/attributes/price").
+	Pointer string
+
+	// Field is the struct member the value was decoded to, as
+	// "Type.Member". It is empty for members not mapped by any struct member.
+	Field string
+
+	// Expected is the Go type of the struct member, and Actual the JSON type
+	// of the decoded value ("string", "number", "boolean", "object", "array"
+	// or "null"). Either is empty when not applicable.
+	Expected string
+	Actual   string
+
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	msg := e.Pointer
+	if e.Field != "" {
+		msg += " (" + e.Field + ")"
+	}
+	if e.Expected != "" && e.Actual != "" {
+		msg += ": expected " + e.Expected + ", got " + e.Actual
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// JSONAPIError converts the decoding error to an Error object, with the
+// pointer as source. Mismatching resource types and identifiers result in a
+// 409 Conflict status, and invalid or unknown values in a 422 Unprocessable
+// Entity status. Other errors, such as invalid tags, are faults of the server
+// and result in a 500 Internal Server Error status without source.
+func (e *DecodeError) JSONAPIError() *Error {
+	err := NewError()
+	switch {
+	case errors.Is(e.Err, ErrDecodingInvalidIDType),
+		errors.Is(e.Err, ErrIDMismatch):
+		err.Status = "409"
+		err.Title = "Conflict"
+	case errors.Is(e.Err, ErrDecodingInvalidValue),
+		errors.Is(e.Err, ErrDecodingInvalidType),
+		errors.Is(e.Err, ErrDecodingOverflow),
+		errors.Is(e.Err, ErrDecodingUnknownMember),
+		errors.Is(e.Err, ErrResourceLinkageBadType):
+		err.Status = "422"
+		err.Title = "Unprocessable Entity"
+	default:
+		err.Status = "500"
+		err.Title = "Internal Server Error"
+		return err
+	}
+	err.Detail = e.Error()
+	err.Source = &ErrorSource{Pointer: e.Pointer}
+	return err
+}
+
 // Unmarshal fills up an interface from a JSONAPI root.
 // This function is equivalent to creating a blank Context and unmarshaling
 // the root with it.
@@ -40,159 +133,654 @@ func Unmarshal(r *Root, v interface{}) error {
 }
 
 // Unmarshal fills up an interface from a JSONAPI root, using c as the Context.
+// If the root is an error document, its Errors are returned as the error, and
+// if it has no data member, ErrDecodingNoData is returned. A null data member
+// sets the interface to its zero value.
+// The interface must be a pointer to a struct when the root contains a single
+// resource, and a pointer to a slice of structs when it contains many.
+// Relationships tagged with `jsonapi:"relationship,[key],embed,[type]"` are
+// filled from the included resources of the root.
 func (c *Context) Unmarshal(r *Root, i interface{}) error {
 	d := &decoder{
 		Context: c,
 	}
 
+	if r.HasErrors() {
+		return r.Errors
+	}
+	if r.Data == nil {
+		return ErrDecodingNoData
+	}
+	d.indexResources(r)
+
+	v := reflect.ValueOf(i)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return ErrDecodingInvalidType
+	}
+
+	if index, isDocument := documentDataField(v.Elem()); isDocument {
+		document := v.Elem()
+		data := document.Field(index)
+		if data.Kind() == reflect.Ptr {
+			if data.IsNil() {
+				data.Set(reflect.New(data.Type().Elem()))
+			}
+		} else {
+			data = data.Addr()
+		}
+		err := d.unmarshalData(r, data)
+		if err != nil && !c.CollectErrors {
+			return err
+		}
+		var errs ErrorList
+		errs = errs.appendError(err)
+		errs = errs.appendError(d.decodeDocumentMeta(document, r.Meta))
+		return errs.err()
+	}
+	return d.unmarshalData(r, v)
+}
+
+// unmarshalData fills up the value pointed by v with the primary data of the
+// root.
+func (d *decoder) unmarshalData(r *Root, v reflect.Value) error {
+	var errs ErrorList
+	if r.Data.isNull() {
+		v.Elem().Set(reflect.Zero(v.Elem().Type()))
+		return nil
+	}
 	if r.Data.Type == ResourcesOne {
-		v := reflect.ValueOf(i)
-		if v.Kind() == reflect.Ptr {
+		if v.Elem().Kind() == reflect.Struct {
 			d.Resource = r.Data.Data[0]
+			d.Pointer = "/data"
+			d.registerDecoded(v)
 			return d.unmarshalResource(v.Elem())
 		}
 	} else if r.Data.Type == ResourcesMany {
-		v := reflect.ValueOf(i)
+		v = v.Elem()
 		if v.Kind() == reflect.Slice {
 			v.SetLen(0)
 			vType := v.Type().Elem()
-			for _, resource := range r.Data.Data {
-				vElem := reflect.New(vType)
+			for it, resource := range r.Data.Data {
+				vElem := reflect.New(vType).Elem()
 				d.Resource = resource
+				d.Pointer = "/data/" + strconv.Itoa(it)
 				err := d.unmarshalResource(vElem)
 				if err != nil {
+					if !d.Context.CollectErrors {
+						return err
+					}
+					errs = errs.appendError(err)
+				}
+				v.Set(reflect.Append(v, vElem))
+			}
+			return errs.err()
+		}
+	}
+	return &DecodeError{
+		Pointer:  "/data",
+		Expected: v.Type().String(),
+		Actual:   jsonTypeName(reflect.ValueOf(r.Data.Data)),
+		Err:      ErrDecodingInvalidType,
+	}
+}
+
+// decodeDocumentMeta fills up the meta members of a document struct from the
+// top-level meta object.
+func (d *decoder) decodeDocumentMeta(v reflect.Value, meta Meta) error {
+	t := v.Type()
+	var errs ErrorList
+	for _, f := range planFor(t).Fields {
+		if f.Kind != TagMeta {
+			continue
+		}
+		if len(f.Tags) < 2 {
+			return ErrDecodingInvalidTag
+		}
+		if value, err := meta.GetMeta(f.Key); err == nil {
+			err = setAttribute(v.Field(f.Index), reflect.ValueOf(value),
+				d.Context.Strict)
+			if err = d.lenient(err); err != nil {
+				err = &DecodeError{
+					Pointer:  "/" + f.Member,
+					Field:    t.Name() + "." + f.Field.Name,
+					Expected: f.Field.Type.String(),
+					Actual:   jsonTypeName(reflect.ValueOf(value)),
+					Err:      err,
+				}
+				if !d.Context.CollectErrors {
 					return err
 				}
-				reflect.Append(v, vElem)
+				errs = errs.appendError(err)
 			}
-			return nil
 		}
 	}
-	return ErrDecodingInvalidType
+	return errs.err()
+}
+
+// decodedKey identifies a resource decoded to a specific pointer type.
+type decodedKey struct {
+	resourceKey
+	Type reflect.Type
 }
 
 type decoder struct {
 	Context  *Context
 	Resource *Resource
+
+	// Pointer is the JSON Pointer to the current resource.
+	Pointer string
+
+	// Resources indexes every resource of the document, primary data
+	// included, by type and identifier.
+	Resources map[resourceKey]*Resource
+
+	// Decoded contains the pointers already allocated for a resource, so
+	// that shared references and cycles resolve to the same value.
+	Decoded map[decodedKey]reflect.Value
+
+	// InProgress contains the resources currently being decoded by value,
+	// which can't be resolved again without looping forever.
+	InProgress map[resourceKey]bool
+
+	// Pointers contains the JSON Pointer to every included resource.
+	Pointers map[*Resource]string
+}
+
+func (d *decoder) indexResources(r *Root) {
+	d.Resources = make(map[resourceKey]*Resource)
+	d.Decoded = make(map[decodedKey]reflect.Value)
+	d.InProgress = make(map[resourceKey]bool)
+	d.Pointers = make(map[*Resource]string)
+	for it, resource := range r.Data.Data {
+		if resource != nil {
+			d.Resources[resourceKey{resource.Type, resource.ID}] = resource
+			d.Pointers[resource] = "/data"
+			if r.Data.Type == ResourcesMany {
+				d.Pointers[resource] += "/" + strconv.Itoa(it)
+			}
+		}
+	}
+	for it, resource := range r.Included {
+		if resource != nil {
+			d.Resources[resourceKey{resource.Type, resource.ID}] = resource
+			d.Pointers[resource] = "/included/" + strconv.Itoa(it)
+		}
+	}
+}
+
+// registerDecoded marks the pointer v as the decoded value of the current
+// resource.
+func (d *decoder) registerDecoded(v reflect.Value) {
+	key := resourceKey{d.Resource.Type, d.Resource.ID}
+	d.Decoded[decodedKey{key, v.Type()}] = v
 }
 
 func (d *decoder) unmarshalResource(v reflect.Value) error {
+	if v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		d.registerDecoded(v)
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return ErrDecodingInvalidType
+	}
+
 	t := v.Type()
-	for i := 0; i < t.NumField(); i++ {
-		f := t.Field(i)
-		tags := strings.Split(f.Tag.Get("jsonapi"), ",")
+	plan := planFor(t)
+	var errs ErrorList
+	for _, f := range plan.Fields {
 		var err error
-		switch tags[0] {
+		switch f.Kind {
 		case TagIdentifier:
-			err = d.decodeIdentifier(v.Field(i), tags)
+			err = d.decodeIdentifier(v.Field(f.Index), f.Tags)
 		case TagAttribute:
-			err = d.decodeAttribute(v.Field(i), tags)
+			err = d.decodeAttribute(v.Field(f.Index), f.Tags)
 		case TagRelationship:
-			err = d.decodeRelationship(v.Field(i), tags)
+			err = d.decodeRelationship(v.Field(f.Index), f.Tags)
+		case TagLink:
+			err = d.decodeLink(v.Field(f.Index), f.Tags)
+		case TagMeta:
+			err = d.decodeMeta(v.Field(f.Index), f.Tags)
 		}
 		if err != nil {
-			return err
+			err = d.decodeError(t, f, err)
+			if !d.Context.CollectErrors {
+				return err
+			}
+			errs = errs.appendError(err)
 		}
 	}
-	return nil
+	if d.Context.Strict {
+		errs = errs.appendError(d.checkUnknownMembers(plan))
+	}
+	return errs.err()
+}
+
+// checkUnknownMembers returns an error if the current resource has an
+// attribute or a relationship that isn't mapped by any member of the struct
+// of the given plan.
+func (d *decoder) checkUnknownMembers(plan *typePlan) error {
+	known := plan.Members
+
+	// Members are sorted so that the reported errors are deterministic.
+	var errs ErrorList
+	for _, key := range sortedKeys(d.Resource.Attributes) {
+		if member := "attributes/" + escapePointer(key); !known[member] {
+			errs = append(errs, &DecodeError{
+				Pointer: d.Pointer + "/" + member,
+				Actual:  jsonTypeName(reflect.ValueOf(d.Resource.Attributes[key])),
+				Err:     ErrDecodingUnknownMember,
+			})
+		}
+	}
+	for _, key := range sortedKeys(d.Resource.Relationships) {
+		if member := "relationships/" + escapePointer(key); !known[member] {
+			errs = append(errs, &DecodeError{
+				Pointer: d.Pointer + "/" + member,
+				Actual:  "object",
+				Err:     ErrDecodingUnknownMember,
+			})
+		}
+	}
+	if len(errs) > 0 && !d.Context.CollectErrors {
+		return errs[0]
+	}
+	return errs.err()
+}
+
+// decodeError returns err as a DecodeError located on the member of the
+// current resource that the field f of the struct type t maps to. Errors
+// that are already located, like those of embedded resources, are returned
+// as is.
+func (d *decoder) decodeError(t reflect.Type, f *fieldPlan,
+	err error) error {
+	var decodeErr *DecodeError
+	if errors.As(err, &decodeErr) {
+		return err
+	}
+
+	var value interface{}
+	hasValue := true
+	switch f.Kind {
+	case TagIdentifier:
+		value = d.Resource.ID
+	case TagAttribute:
+		value, hasValue = d.Resource.Attributes[f.Key]
+	case TagRelationship:
+		value, hasValue = d.Resource.Relationships[f.Key]
+	case TagLink:
+		value, hasValue = d.Resource.Links[f.Key]
+	case TagMeta:
+		value, hasValue = d.Resource.Meta[f.Key]
+	}
+	member := f.Member
+	if member == "" {
+		member = f.Kind
+	}
+	decodeErr = &DecodeError{
+		Pointer:  d.Pointer + "/" + member,
+		Field:    t.Name() + "." + f.Field.Name,
+		Expected: f.Field.Type.String(),
+		Err:      err,
+	}
+	if f.Kind == TagIdentifier && errors.Is(err, ErrDecodingInvalidIDType) {
+		// A mismatching type is reported on the type member, whose value
+		// isn't related to the Go type of the identifier.
+		decodeErr.Pointer = d.Pointer + "/type"
+		decodeErr.Expected = ""
+		hasValue = false
+	}
+	if hasValue {
+		decodeErr.Actual = jsonTypeName(reflect.ValueOf(value))
+	}
+	return decodeErr
+}
+
+// jsonTypeName returns the name of the JSON type v is marshaled to.
+func jsonTypeName(v reflect.Value) string {
+	for v.Kind() == reflect.Interface || v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return "null"
+		}
+		v = v.Elem()
+	}
+	if !v.IsValid() {
+		return "null"
+	}
+	if v.Type() == jsonNumberType {
+		return "number"
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr, reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return "object"
+}
+
+var pointerEscaper = strings.NewReplacer("~", "~0", "/", "~1")
+
+// escapePointer escapes a member name to be used as a JSON Pointer
+// reference token.
+func escapePointer(key string) string {
+	return pointerEscaper.Replace(key)
 }
 
+// lenient drops the parsing errors of err, unless the context is strict.
+func (d *decoder) lenient(err error) error {
+	if err != nil && !d.Context.Strict &&
+		errors.Is(err, ErrDecodingInvalidValue) {
+		return nil
+	}
+	return err
+}
+
+// memberName returns the name of the resource object member a field marked
+// with the given tags is decoded from, as a relative JSON Pointer.
+func memberName(tags []string) string {
+	switch tags[0] {
+	case TagIdentifier:
+		return "id"
+	case TagAttribute:
+		return "attributes/" + escapePointer(tags[1])
+	case TagRelationship:
+		return "relationships/" + escapePointer(tags[1])
+	case TagLink:
+		return "links/" + escapePointer(tags[1])
+	case TagMeta:
+		return "meta/" + escapePointer(tags[1])
+	}
+	return tags[0]
+}
+
+// typeMatches returns whether or not the type of a decoded resource matches
+// the type of a tag. The type of the resource may be the plural form of the
+// type of the tag.
+func typeMatches(tag, typ string) bool {
+	return tag == typ || tag+"s" == typ
+}
+
+// decodeIdentifier fills the identifier of the struct. Resources without id,
+// as sent by clients creating a resource, leave the identifier untouched.
 func (d *decoder) decodeIdentifier(v reflect.Value, tags []string) error {
-	if tags[1] != d.Resource.Type {
-			if d.Resource.Type[len(d.Resource.Type)-1:] == "s" {
-				d.Resource.Type = d.Resource.Type[:len(d.Resource.Type)-1]
-				if tags[1] != d.Resource.Type {
-					return ErrDecodingInvalidIDType
-				}
-			}
+	if !typeMatches(tags[1], d.Resource.Type) {
+		return ErrDecodingInvalidIDType
 	}
-	return stringToValue(d.Resource.ID, v)
+	if d.Resource.ID == "" {
+		return nil
+	}
+	return d.lenient(stringToValue(d.Resource.ID, v))
 }
 
 func (d *decoder) decodeAttribute(v reflect.Value, tags []string) error {
 	if attr, err := d.Resource.Attributes.GetAttribute(tags[1]); err == nil {
-		err = setAttribute(v, reflect.ValueOf(attr))
-		return err
+		err = setAttribute(v, reflect.ValueOf(attr), d.Context.Strict)
+		return d.lenient(err)
 	}
 	return nil
 }
 
-// This method only supports "data" relationships. For now.
 func (d *decoder) decodeRelationship(v reflect.Value, tags []string) error {
+	if len(tags) < 2 {
+		return ErrDecodingInvalidTag
+	}
+
+	// Only `jsonapi:"relationship,[key]"` has a 2-value tag.
+	if len(tags) == 2 {
+		r, hasKey := d.Resource.Relationships[tags[1]]
+		if !hasKey || r == nil {
+			return nil
+		}
+		relationshipType := reflect.TypeOf(*r)
+		if v.Type() == relationshipType {
+			v.Set(reflect.ValueOf(*r))
+		} else if v.Type() == reflect.PtrTo(relationshipType) {
+			copied := *r
+			v.Set(reflect.ValueOf(&copied))
+		} else {
+			return ErrDecodingInvalidType
+		}
+		return nil
+	}
+
 	switch tags[2] {
+	case TagRelationshipContext:
+		// Context relationships are templates provided by the server, there
+		// is nothing to read back from them.
+		return nil
+	case TagRelationshipLink:
+		if r, hasKey := d.Resource.Relationships[tags[1]]; hasKey && r != nil {
+			if link, err := r.Links.GetLink(LinkSelf); err == nil {
+				return d.lenient(stringToValue(link, v))
+			}
+		}
+		return nil
+	case TagRelationshipEmbed:
+		return d.decodeEmbed(v, tags)
 	case TagRelationshipData:
 		if len(tags) < 4 {
 			return ErrDecodingInvalidTag
 		}
-		if r, hasKey := d.Resource.Relationships[tags[1]]; hasKey {
-			if r.Data == nil {
+		// As for embedded relationships, a null linkage clears the value
+		// and a linkage replaces it.
+		r, hasKey := d.Resource.Relationships[tags[1]]
+		if !hasKey || r == nil || r.Data == nil {
+			return nil
+		}
+		if r.Data.Type == ResourceLinkageToOne {
+			if r.Data.Data[0] == nil {
+				v.Set(reflect.Zero(v.Type()))
 				return nil
 			}
-			if r.Data.Type == ResourceLinkageToOne {
-				return d.decodeResourceIdentifier(v, r.Data.Data[0], tags)
-			} else if r.Data.Type == ResourceLinkageToMany {
-				for it := 0; it < len(r.Data.Data); it++ {
-					vType := v.Type().Elem()
-					vElem := reflect.New(vType)
-					err := d.decodeResourceIdentifier(vElem,
-						r.Data.Data[it], tags)
-					if err != nil {
-						return err
-					}
-					v.Set(reflect.Append(v, vElem.Elem()))
-				}
-			} else {
+			return d.decodeResourceIdentifier(v, r.Data.Data[0], tags)
+		} else if r.Data.Type == ResourceLinkageToMany {
+			if v.Kind() != reflect.Slice {
 				return ErrDecodingInvalidType
 			}
+			slice := reflect.MakeSlice(v.Type(), 0, len(r.Data.Data))
+			for it := 0; it < len(r.Data.Data); it++ {
+				vElem := reflect.New(v.Type().Elem())
+				err := d.decodeResourceIdentifier(vElem, r.Data.Data[it],
+					tags)
+				if err != nil {
+					return err
+				}
+				slice = reflect.Append(slice, vElem.Elem())
+			}
+			v.Set(slice)
+		} else {
+			return ErrDecodingInvalidType
 		}
 	}
 	return nil
 }
 
+func (d *decoder) decodeLink(v reflect.Value, tags []string) error {
+	if len(tags) < 2 {
+		return ErrDecodingInvalidTag
+	}
+	link, hasKey := d.Resource.Links[tags[1]]
+	if !hasKey {
+		return nil
+	}
+
+	// Links can be decoded to Link objects, whether they were marshaled as
+	// objects or strings, and to any value that can be set from a string.
+	var linkObject *Link
+	switch l := link.(type) {
+	case *Link:
+		linkObject = l
+	case string:
+		linkObject = &Link{HRef: l}
+	case map[string]interface{}:
+		linkObject = NewLink()
+		linkObject.HRef, _ = l["href"].(string)
+		if meta, ok := l["meta"].(map[string]interface{}); ok {
+			linkObject.Meta = meta
+		}
+	default:
+		return ErrLinkUnsupportedType
+	}
+
+	switch v.Interface().(type) {
+	case *Link:
+		v.Set(reflect.ValueOf(linkObject))
+	case Link:
+		v.Set(reflect.ValueOf(*linkObject))
+	default:
+		return d.lenient(stringToValue(linkObject.HRef, v))
+	}
+	return nil
+}
+
+func (d *decoder) decodeMeta(v reflect.Value, tags []string) error {
+	if len(tags) < 2 {
+		return ErrDecodingInvalidTag
+	}
+	if meta, err := d.Resource.Meta.GetMeta(tags[1]); err == nil {
+		err = setAttribute(v, reflect.ValueOf(meta), d.Context.Strict)
+		return d.lenient(err)
+	}
+	return nil
+}
+
 func (d *decoder) decodeResourceIdentifier(v reflect.Value,
 	r *ResourceIdentifier, tags []string) error {
-	if tags[3] != r.Type {
-		if r.Type[len(r.Type)-1:] == "s" {
-			r.Type = r.Type[:len(r.Type)-1]
-			if tags[3] != r.Type {
-				return ErrDecodingInvalidIDType
+	if !typeMatches(tags[3], r.Type) {
+		return ErrDecodingInvalidIDType
+	}
+	return d.lenient(stringToValue(r.ID, v))
+}
+
+// decodeEmbed fills a struct, or slice of structs, relationship with the
+// related resources found in the document. Related resources that are not
+// part of the document only get their identifier set.
+func (d *decoder) decodeEmbed(v reflect.Value, tags []string) error {
+	if len(tags) < 4 {
+		return ErrDecodingInvalidTag
+	}
+	// Relationships without data member leave the value untouched, while a
+	// null linkage clears it.
+	r, hasKey := d.Resource.Relationships[tags[1]]
+	if !hasKey || r == nil || r.Data == nil {
+		return nil
+	}
+
+	if r.Data.Type == ResourceLinkageToOne {
+		if r.Data.Data[0] == nil {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		return d.decodeIncluded(v, r.Data.Data[0], tags)
+	}
+	if v.Kind() != reflect.Slice {
+		return ErrDecodingInvalidType
+	}
+	var errs ErrorList
+	slice := reflect.MakeSlice(v.Type(), 0, len(r.Data.Data))
+	for _, identifier := range r.Data.Data {
+		vElem := reflect.New(v.Type().Elem()).Elem()
+		if err := d.decodeIncluded(vElem, identifier, tags); err != nil {
+			if !d.Context.CollectErrors {
+				return err
 			}
+			errs = errs.appendError(err)
 		}
+		slice = reflect.Append(slice, vElem)
 	}
-	return stringToValue(r.ID, v)
+	v.Set(slice)
+	return errs.err()
 }
 
+func (d *decoder) decodeIncluded(v reflect.Value,
+	r *ResourceIdentifier, tags []string) error {
+	if !typeMatches(tags[3], r.Type) {
+		return ErrDecodingInvalidIDType
+	}
+	key := resourceKey{r.Type, r.ID}
+	resource := d.Resources[key]
+	if resource == nil {
+		resource = &Resource{ID: r.ID, Type: r.Type}
+	}
+
+	sub := *d
+	sub.Resource = resource
+	if pointer, included := d.Pointers[resource]; included {
+		sub.Pointer = pointer
+	} else {
+		sub.Pointer = d.Pointer + "/relationships/" + escapePointer(tags[1]) +
+			"/data"
+	}
+	if v.Kind() == reflect.Ptr {
+		if ptr, decoded := d.Decoded[decodedKey{key, v.Type()}]; decoded {
+			v.Set(ptr)
+			return nil
+		}
+		v.Set(reflect.New(v.Type().Elem()))
+		return sub.unmarshalResource(v)
+	}
+
+	// Values can't be shared, so a cycle is cut by only setting the
+	// identifier of the resource.
+	if d.InProgress[key] {
+		sub.Resource = &Resource{ID: r.ID, Type: r.Type}
+	} else {
+		d.InProgress[key] = true
+		defer delete(d.InProgress, key)
+	}
+	return sub.unmarshalResource(v)
+}
+
+// stringToValue parses str to v. When str can't be parsed to the type of v,
+// v is set to the value returned by the parsing function anyway, and
+// ErrDecodingInvalidValue is returned.
 func stringToValue(str string, v reflect.Value) error {
 	if v.Kind() == reflect.Ptr && v.IsNil() == false {
 		v = v.Elem()
 	}
+	var textErr error
 	if v.CanInterface() {
 		if u, ok := v.Interface().(encoding.TextUnmarshaler); ok {
-			err := u.UnmarshalText([]byte(str))
-			if err == nil {
+			textErr = u.UnmarshalText([]byte(str))
+			if textErr == nil {
 				return nil
 			}
 		}
 		if u, ok := v.Addr().Interface().(encoding.TextUnmarshaler); ok {
-			err := u.UnmarshalText([]byte(str))
-			if err == nil {
+			textErr = u.UnmarshalText([]byte(str))
+			if textErr == nil {
 				return nil
 			}
 		}
 	}
+
+	var err error
 	switch v.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-		nb, _ := strconv.ParseInt(str, 10, 64)
+		var nb int64
+		nb, err = strconv.ParseInt(str, 10, v.Type().Bits())
 		v.SetInt(nb)
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
 		reflect.Uint64, reflect.Uintptr:
-		nb, _ := strconv.ParseUint(str, 10, 64)
+		var nb uint64
+		nb, err = strconv.ParseUint(str, 10, v.Type().Bits())
 		v.SetUint(nb)
 	case reflect.Float32, reflect.Float64:
-		nb, _ := strconv.ParseFloat(str, 64)
+		var nb float64
+		nb, err = strconv.ParseFloat(str, v.Type().Bits())
 		v.SetFloat(nb)
 	case reflect.Bool:
-		boolean, _ := strconv.ParseBool(str)
+		var boolean bool
+		boolean, err = strconv.ParseBool(str)
 		v.SetBool(boolean)
 	case reflect.String:
 		v.SetString(str)
@@ -200,78 +788,235 @@ func stringToValue(str string, v reflect.Value) error {
 		if v.IsNil() {
 			v.Set(reflect.New(v.Type().Elem()))
 		}
-		stringToValue(str, v.Elem())
+		return stringToValue(str, v.Elem())
 	default:
+		if textErr != nil {
+			return fmt.Errorf("%w: %v", ErrDecodingInvalidValue, textErr)
+		}
 		return ErrDecodingInvalidType
 	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrDecodingInvalidValue, err)
+	}
 	return nil
 }
 
+var jsonNumberType = reflect.TypeOf(json.Number(""))
+
+// Bounds of the float64 values that can be converted to 64 bits integers.
+const (
+	minInt64Float  = -(1 << 63)
+	maxInt64Float  = 1 << 63
+	maxUint64Float = 1 << 64
+)
+
 func numberToValue(nbr float64, v reflect.Value) error {
 	switch v.Kind() {
 	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if nbr < minInt64Float || nbr >= maxInt64Float ||
+			v.OverflowInt(int64(nbr)) {
+			return ErrDecodingOverflow
+		}
 		v.SetInt(int64(nbr))
 	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
 		reflect.Uint64, reflect.Uintptr:
+		if nbr < 0 || nbr >= maxUint64Float || v.OverflowUint(uint64(nbr)) {
+			return ErrDecodingOverflow
+		}
 		v.SetUint(uint64(nbr))
 	case reflect.Float32, reflect.Float64:
+		if v.OverflowFloat(nbr) {
+			return ErrDecodingOverflow
+		}
 		v.SetFloat(nbr)
 	case reflect.Bool:
-		v.SetBool(nbr == 0.0)
+		v.SetBool(nbr != 0.0)
 	case reflect.String:
 		v.SetString(strconv.FormatFloat(nbr, 'f', -1, 64))
 	case reflect.Ptr:
 		if v.IsNil() {
 			v.Set(reflect.New(v.Type().Elem()))
 		}
-		numberToValue(nbr, v.Elem())
+		return numberToValue(nbr, v.Elem())
 	default:
 		return ErrDecodingInvalidType
 	}
 	return nil
 }
 
-func booleanToValue(val bool, v reflect.Value) error {
+// jsonNumberToValue decodes a json.Number to v without going through a
+// float64 when v is an integer, so that no precision is lost.
+func jsonNumberToValue(nbr json.Number, v reflect.Value) error {
 	switch v.Kind() {
-		case reflect.Bool:
-			v.SetBool(val)
-		default:
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(string(nbr), 10, 64)
+		if err != nil {
+			if errors.Is(err, strconv.ErrRange) {
+				return ErrDecodingOverflow
+			}
+			// Not an integer literal (e.g. 1e3), try again as a float.
+			f, err := nbr.Float64()
+			if err != nil || f != math.Trunc(f) {
+				return ErrDecodingInvalidType
+			}
+			return numberToValue(f, v)
+		}
+		if v.OverflowInt(i) {
+			return ErrDecodingOverflow
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		u, err := strconv.ParseUint(string(nbr), 10, 64)
+		if err != nil {
+			if errors.Is(err, strconv.ErrRange) {
+				return ErrDecodingOverflow
+			}
+			f, err := nbr.Float64()
+			if err != nil || f != math.Trunc(f) {
+				return ErrDecodingInvalidType
+			}
+			return numberToValue(f, v)
+		}
+		if v.OverflowUint(u) {
+			return ErrDecodingOverflow
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(string(nbr), v.Type().Bits())
+		if err != nil {
+			if errors.Is(err, strconv.ErrRange) {
+				return ErrDecodingOverflow
+			}
 			return ErrDecodingInvalidType
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		f, err := nbr.Float64()
+		if err != nil {
+			return ErrDecodingInvalidType
+		}
+		v.SetBool(f != 0.0)
+	case reflect.String:
+		v.SetString(nbr.String())
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return jsonNumberToValue(nbr, v.Elem())
+	default:
+		return ErrDecodingInvalidType
 	}
 	return nil
 }
 
-func invalidToValue(v reflect.Value) error {
+func booleanToValue(val bool, v reflect.Value) error {
 	switch v.Kind() {
-		case reflect.Bool:
-			v.SetBool(false)
-		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
-			v.SetInt(0)
-		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
-			reflect.Uint64, reflect.Uintptr:
-			v.SetUint(0)
-		case reflect.Float32, reflect.Float64:
-			v.SetFloat(0.0)
-		case reflect.Ptr:
-			v.SetPointer(nil)
-		case reflect.String:
-			return stringToValue("", v)
-		default:
-			return ErrDecodingInvalidType
+	case reflect.Bool:
+		v.SetBool(val)
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return booleanToValue(val, v.Elem())
+	default:
+		return ErrDecodingInvalidType
 	}
 	return nil
 }
 
-func setAttribute(dst, src reflect.Value) error {
+// invalidToValue sets v to its zero value, as null is decoded by
+// encoding/json.
+func invalidToValue(v reflect.Value) error {
+	if !v.CanSet() {
+		return ErrCantSet
+	}
+	v.Set(reflect.Zero(v.Type()))
+	return nil
+}
+
+// complexToValue decodes an object or an array to v, the same way
+// encoding/json would decode it to a value of the type of v. Struct members
+// are thus matched with their json tags. If strict is true, unknown struct
+// members are reported as errors.
+func complexToValue(src, v reflect.Value, strict bool) error {
+	data, err := json.Marshal(src.Interface())
+	if err != nil {
+		return err
+	}
+	ptr := reflect.New(v.Type())
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	if strict {
+		decoder.DisallowUnknownFields()
+	}
+	if err := decoder.Decode(ptr.Interface()); err != nil {
+		return fmt.Errorf("%w: %v", ErrDecodingInvalidType, err)
+	}
+	v.Set(ptr.Elem())
+	return nil
+}
+
+// setAttribute decodes the JSON value src to dst. If strict is true, the
+// kind of src must match the type of dst: strings can't be decoded to
+// numbers, nor numbers to strings or booleans.
+func setAttribute(dst, src reflect.Value, strict bool) error {
+	// Values that were never marshaled to JSON keep their original type.
+	if src.IsValid() && src.Type().AssignableTo(dst.Type()) {
+		dst.Set(src)
+		return nil
+	}
+
+	if src.IsValid() && src.Type() == jsonNumberType {
+		if strict && !isNumberType(dst.Type()) {
+			return ErrDecodingInvalidType
+		}
+		return jsonNumberToValue(json.Number(src.String()), dst)
+	}
+
 	switch src.Kind() {
 	case reflect.String:
+		if strict && !isStringType(dst.Type()) {
+			return ErrDecodingInvalidType
+		}
 		return stringToValue(src.String(), dst)
 	case reflect.Float64:
+		if strict && !isNumberType(dst.Type()) {
+			return ErrDecodingInvalidType
+		}
 		return numberToValue(src.Float(), dst)
 	case reflect.Bool:
 		return booleanToValue(src.Bool(), dst)
+	case reflect.Map, reflect.Slice, reflect.Array, reflect.Struct:
+		return complexToValue(src, dst, strict)
 	case reflect.Invalid:
 		return invalidToValue(dst)
 	}
 	return ErrDecodingInvalidType
 }
+
+var textUnmarshalerType = reflect.TypeOf(new(encoding.TextUnmarshaler)).Elem()
+
+// isNumberType returns whether or not a JSON number can be decoded to a value
+// of type t without changing its meaning.
+func isNumberType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr, reflect.Float32, reflect.Float64:
+		return true
+	}
+	return false
+}
+
+// isStringType returns whether or not a JSON string can be decoded to a value
+// of type t without changing its meaning.
+func isStringType(t reflect.Type) bool {
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.String ||
+		reflect.PtrTo(t).Implements(textUnmarshalerType)
+}
@@ -4,7 +4,6 @@ import (
 	"errors"
 	"reflect"
 	"strconv"
-	"strings"
 )
 
 var (
@@ -18,6 +17,44 @@ var (
 	ErrEncodingInvalidTag = errors.New("Invalid JSONAPI tag")
 )
 
+// EncodeError is an error type describing which member of which resource
+// failed to marshal. It wraps the underlying error, so errors.Is can still be
+// used with the Err* values of this package.
+type EncodeError struct {
+	// Index is the index of the resource in the primary data of a
+	// collection, or -1 for single and included resources.
+	Index int
+
+	// Type and ID identify the resource, ID being empty if the identifier
+	// itself can't be marshaled.
+	Type string
+	ID   string
+
+	// Field is the struct member that failed to marshal, as "Type.Member".
+	Field string
+
+	Err error
+}
+
+func (e *EncodeError) Error() string {
+	msg := e.Type
+	if e.ID != "" {
+		msg += "/" + e.ID
+	}
+	if e.Index >= 0 {
+		msg = "/data/" + strconv.Itoa(e.Index) + " (" + msg + ")"
+	}
+	if e.Field != "" {
+		msg += " " + e.Field
+	}
+	return msg + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *EncodeError) Unwrap() error {
+	return e.Err
+}
+
 // Marshal returns a JSON-marshalable root for the given interface.
 // This function is equivalent to creating a blank Context and marshaling the
 // interface with it.
@@ -28,16 +65,68 @@ func Marshal(v interface{}) (*Root, error) {
 }
 
 // Marshal returns a JSON-marshalable root for the given interface, using c
-// as the Context.
+// as the Context. Errors related to a member of a resource are returned as
+// an EncodeError.
+// Resources embedded with the `jsonapi:"relationship,[key],embed,[type]"` tag
+// are added to the included member of the root.
+// If the interface is a document struct, which has a member marked with the
+// `jsonapi:"data"` tag, this member is used as primary data and the members
+// marked with the `jsonapi:"meta,[key]"` tag are added to the top-level meta.
 func (c *Context) Marshal(i interface{}) (*Root, error) {
+	v := reflect.ValueOf(i)
+	document := reflect.Indirect(v)
+
+	var root *Root
+	var err error
+	if index, isDocument := documentDataField(document); isDocument {
+		root, err = c.marshalData(document.Field(index))
+		if err == nil {
+			err = encodeDocumentMeta(document, root)
+		}
+	} else {
+		root, err = c.marshalData(v)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	c.encodeDocumentMembers(root)
+	if c.Pagination != nil && root.Data.Type == ResourcesMany {
+		c.Pagination.encode(root, len(root.Data.Data))
+	}
+	return root, nil
+}
+
+// encodeDocumentMembers sets the top-level members of the root defined by
+// the context.
+func (c *Context) encodeDocumentMembers(root *Root) {
+	root.JSONAPI = c.JSONAPI
+	for key, link := range c.DocumentLinks {
+		if root.Links == nil {
+			root.Links = NewLinks()
+		}
+		root.Links[key] = link
+	}
+	for key, meta := range c.DocumentMeta {
+		if root.Meta == nil {
+			root.Meta = NewMeta()
+		}
+		root.Meta[key] = meta
+	}
+}
+
+func (c *Context) marshalData(v reflect.Value) (*Root, error) {
 	e := &encoder{
-		Context: c,
+		Context:  c,
+		Included: newInclusion(),
+		Include:  c.Include,
+		Index:    -1,
 	}
 
 	root := new(Root)
-	v := reflect.ValueOf(i)
+	var errs ErrorList
 	switch v.Kind() {
-	case reflect.Struct:
+	case reflect.Struct, reflect.Ptr:
 		root.Data = NewResourcesOne()
 		e.Resource = NewResource()
 		err := e.marshalStruct(v)
@@ -49,55 +138,180 @@ func (c *Context) Marshal(i interface{}) (*Root, error) {
 		root.Data = NewResourcesMany()
 		for it := 0; it < v.Len(); it++ {
 			e.Resource = NewResource()
+			e.Index = it
 			err := e.marshalStruct(v.Index(it))
 			if err != nil {
-				return nil, err
+				if !c.CollectErrors {
+					return nil, err
+				}
+				errs = errs.appendError(err)
+				continue
 			}
 			root.Data.AddResource(e.Resource)
 		}
+		if len(errs) > 0 {
+			return nil, errs
+		}
 	default:
 		return nil, ErrEncodingInvalidType
 	}
+
+	for _, resource := range e.Included.Resources {
+		root.AddIncluded(resource)
+	}
 	return root, nil
 }
 
+// documentDataField returns the index of the member of a document struct
+// marked with the data tag. If v is not a document struct, returns false.
+func documentDataField(v reflect.Value) (int, bool) {
+	if v.Kind() != reflect.Struct {
+		return 0, false
+	}
+	plan := planFor(v.Type())
+	return plan.Data, plan.Data >= 0
+}
+
+// encodeDocumentMeta adds the meta members of a document struct to the
+// top-level meta object of the root.
+func encodeDocumentMeta(v reflect.Value, root *Root) error {
+	for _, f := range planFor(v.Type()).Fields {
+		if f.Kind != TagMeta {
+			continue
+		}
+		if len(f.Tags) < 2 {
+			return ErrEncodingInvalidTag
+		}
+		if root.Meta == nil {
+			root.Meta = NewMeta()
+		}
+		if err := root.Meta.AddMeta(f.Key, v.Field(f.Index).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// inclusion keeps track of the resources side-loaded while marshaling a
+// document, so that every resource is only included once.
+type inclusion struct {
+	Seen      map[resourceKey]bool
+	Resources []*Resource
+}
+
+func newInclusion() *inclusion {
+	return &inclusion{
+		Seen: make(map[resourceKey]bool),
+	}
+}
+
 type encoder struct {
 	Context           *Context
 	Resource          *Resource
+	Included          *inclusion
 	RelationshipCount int
+
+	// Type overrides the type of the identifier tag of the marshaled struct,
+	// as set by the embed tag of included resources.
+	Type string
+
+	// Include holds the include paths relative to the marshaled struct. A nil
+	// value includes every embedded relationship.
+	Include Includes
+
+	// Index is the index of the marshaled struct in the primary data of a
+	// collection, or -1.
+	Index int
 }
 
 func (e *encoder) marshalStruct(v reflect.Value) error {
 	if v.Kind() == reflect.Ptr {
 		v = v.Elem()
 	}
-	t := v.Type()
-	for it := 0; it < t.NumField(); it++ {
-		f := t.Field(it)
-		tags := strings.Split(f.Tag.Get("jsonapi"), ",")
-
+	if v.Kind() != reflect.Struct {
+		return ErrEncodingInvalidType
+	}
+	plan := planFor(v.Type())
+	typ := e.resourceType(plan)
+	var errs ErrorList
+	for _, f := range plan.Fields {
+		if e.omitted(typ, f) {
+			continue
+		}
 		var err error
-		switch tags[0] {
+		switch f.Kind {
 		case TagIdentifier:
-			err = e.encodeIdentifier(v.Field(it), tags)
+			err = e.encodeIdentifier(v.Field(f.Index), f)
 		case TagAttribute:
-			err = e.encodeAttribute(v.Field(it), tags)
+			err = e.encodeAttribute(v.Field(f.Index), f.Tags)
 		case TagRelationship:
-			err = e.encodeRelationship(v.Field(it), tags)
+			err = e.encodeRelationship(v.Field(f.Index), f.Tags)
+		case TagLink:
+			err = e.encodeLink(v.Field(f.Index), f.Tags)
+		case TagMeta:
+			err = e.encodeMeta(v.Field(f.Index), f.Tags)
 		}
 		if err != nil {
-			return err
+			err = e.encodeError(v, typ, f, err)
+			if !e.Context.CollectErrors {
+				return err
+			}
+			errs = errs.appendError(err)
 		}
 	}
-	return nil
+	return errs.err()
 }
 
-func (e *encoder) encodeIdentifier(v reflect.Value, tags []string) (err error) {
-	if len(tags) < 2 {
+// encodeError returns err as an EncodeError located on the member f of the
+// struct v, marshaled as a resource of type typ. Errors of included
+// resources, which are already located, are returned as is.
+func (e *encoder) encodeError(v reflect.Value, typ string, f *fieldPlan,
+	err error) error {
+	if list, isList := err.(ErrorList); isList {
+		located := make(ErrorList, len(list))
+		for it, err := range list {
+			located[it] = e.encodeError(v, typ, f, err)
+		}
+		return located
+	}
+	var encodeErr *EncodeError
+	if errors.As(err, &encodeErr) {
+		return err
+	}
+	id, _ := structIdentifier(v)
+	return &EncodeError{
+		Index: e.Index,
+		Type:  typ,
+		ID:    id,
+		Field: v.Type().Name() + "." + f.Field.Name,
+		Err:   err,
+	}
+}
+
+// resourceType returns the type of the resource marshaled from a struct of
+// the given plan.
+func (e *encoder) resourceType(plan *typePlan) string {
+	if e.Type != "" || plan.Identifier == nil {
+		return e.Type
+	}
+	return plan.Identifier.TypeName
+}
+
+// omitted returns whether or not the member f of a resource of type typ is
+// left out by the sparse fieldsets of the context.
+func (e *encoder) omitted(typ string, f *fieldPlan) bool {
+	if f.Kind != TagAttribute && f.Kind != TagRelationship {
+		return false
+	}
+	return !e.Context.Fieldsets.Allows(typ, f.Key)
+}
+
+func (e *encoder) encodeIdentifier(v reflect.Value, f *fieldPlan) (err error) {
+	if len(f.Tags) < 2 {
 		return ErrEncodingInvalidTag
 	}
-	e.Resource.ID, err = valueToString(v)
-	e.Resource.Type = tags[1]
+	e.Resource.ID, err = f.ToString(v)
+	e.Resource.Type = f.TypeName
 	return
 }
 
@@ -136,7 +350,9 @@ func (e *encoder) encodeRelationship(v reflect.Value, tags []string) error {
 				return ErrContextNotFound
 			}
 			r := *rPtr
-			populateStruct(reflect.ValueOf(r), v)
+			if err := populateStruct(reflect.ValueOf(&r).Elem(), v); err != nil {
+				return err
+			}
 			e.Resource.Relationships[tags[1]] = &r
 		case TagRelationshipLink:
 			if v.Kind() != reflect.String {
@@ -145,6 +361,8 @@ func (e *encoder) encodeRelationship(v reflect.Value, tags []string) error {
 			r := NewRelationship()
 			r.Links.AddLink("self", v.String())
 			e.Resource.Relationships[tags[1]] = r
+		case TagRelationshipEmbed:
+			return e.encodeEmbed(v, tags)
 		case TagRelationshipData:
 			if len(tags) < 4 {
 				return ErrEncodingInvalidTag
@@ -180,6 +398,114 @@ func (e *encoder) encodeRelationship(v reflect.Value, tags []string) error {
 	return nil
 }
 
+// encodeEmbed writes the resource linkage of a struct, or slice of structs,
+// relationship and side-loads the related resources.
+func (e *encoder) encodeEmbed(v reflect.Value, tags []string) error {
+	if len(tags) < 4 {
+		return ErrEncodingInvalidTag
+	}
+	r := NewRelationship()
+
+	var errs ErrorList
+	if v.Kind() == reflect.Array || v.Kind() == reflect.Slice {
+		r.Data = NewResourceLinkageToMany()
+		for it := 0; it < v.Len(); it++ {
+			resource, err := e.includeStruct(v.Index(it), tags[3], tags[1])
+			if err != nil {
+				if !e.Context.CollectErrors {
+					return err
+				}
+				errs = errs.appendError(err)
+			}
+			if resource != nil {
+				r.Data.AddResourceIdentifier(resource)
+			}
+		}
+	} else {
+		r.Data = NewResourceLinkageToOne()
+		resource, err := e.includeStruct(v, tags[3], tags[1])
+		if err != nil {
+			return err
+		}
+		// A nil resource identifier is marshaled as a null linkage.
+		r.Data.SetResourceIdentifier(resource)
+	}
+	e.Resource.Relationships[tags[1]] = r
+	return errs.err()
+}
+
+// includeStruct marshals a struct related through the relationship of the
+// given key as a resource of the given type, adds it to the included
+// resources if it wasn't already, and returns its identifier. Structs whose
+// relationship isn't part of the include paths are only identified.
+// Nil pointers return a nil identifier.
+func (e *encoder) includeStruct(v reflect.Value,
+	typ, relationship string) (*ResourceIdentifier, error) {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil, nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil, ErrEncodingInvalidType
+	}
+
+	id, err := structIdentifier(v)
+	if err != nil {
+		return nil, err
+	}
+	identifier := NewResourceIdentifier()
+	identifier.ID = id
+	identifier.Type = typ
+
+	include, selected := e.Include, true
+	if e.Include != nil {
+		include, selected = e.Include[relationship]
+	}
+	if !selected {
+		return identifier, nil
+	}
+
+	// The resource is marked as seen before being marshaled, so that cyclic
+	// references don't recurse endlessly. Resources that were already seen
+	// are only marshaled again to follow longer include paths, which are
+	// finite.
+	key := resourceKey{typ, id}
+	seen := e.Included.Seen[key]
+	if seen && len(include) == 0 {
+		return identifier, nil
+	}
+	e.Included.Seen[key] = true
+
+	sub := &encoder{
+		Context:  e.Context,
+		Resource: NewResource(),
+		Included: e.Included,
+		Type:     typ,
+		Include:  include,
+		Index:    -1,
+	}
+	if err := sub.marshalStruct(v); err != nil {
+		return nil, err
+	}
+	sub.Resource.Type = typ
+	if !seen {
+		e.Included.Resources = append(e.Included.Resources, sub.Resource)
+	}
+	return identifier, nil
+}
+
+// structIdentifier returns the string representation of the field marked
+// with the identifier tag of a struct.
+func structIdentifier(v reflect.Value) (string, error) {
+	identifier := planFor(v.Type()).Identifier
+	if identifier == nil {
+		return "", ErrEncodingInvalidType
+	}
+	return identifier.ToString(v.Field(identifier.Index))
+}
+
 func (e *encoder) encodeLink(v reflect.Value, tags []string) error {
 	if len(tags) < 2 {
 		return ErrEncodingInvalidTag
@@ -187,24 +513,41 @@ func (e *encoder) encodeLink(v reflect.Value, tags []string) error {
 
 	// Only `jsonapi:"link,[key]"` has a 2-value tag.
 	if len(tags) == 2 {
-		str, err := valueToString(v)
-		if err != nil {
-			return err
+		switch link := v.Interface().(type) {
+		case *Link:
+			if link != nil {
+				e.Resource.Links.AddLinkObject(tags[1], link)
+			}
+		case Link:
+			e.Resource.Links.AddLinkObject(tags[1], &link)
+		default:
+			str, err := valueToString(v)
+			if err != nil {
+				return err
+			}
+			e.Resource.Links.AddLink(tags[1], str)
 		}
-		e.Resource.Links.AddLink(tags[1], str)
 	} else {
-		if len(tags) < 3 {
-			return ErrEncodingInvalidTag
-		}
 		switch tags[2] {
-		case "context":
+		case TagLinkContext:
 			lPtr := e.Context.Links[tags[1]]
 			if lPtr == nil {
 				return ErrContextNotFound
 			}
+
+			// The template is copied, so that populating it doesn't alter
+			// the one stored in the context.
 			l := *lPtr
-			populateStruct(reflect.ValueOf(l), v)
-			e.Resource.Links[tags[1]] = v
+			l.Meta = make(map[string]interface{}, len(lPtr.Meta))
+			for key, value := range lPtr.Meta {
+				l.Meta[key] = value
+			}
+			if err := populateStruct(reflect.ValueOf(&l).Elem(), v); err != nil {
+				return err
+			}
+			e.Resource.Links.AddLinkObject(tags[1], &l)
+		default:
+			return ErrEncodingInvalidTag
 		}
 	}
 	return nil
@@ -214,8 +557,7 @@ func (e *encoder) encodeMeta(v reflect.Value, tags []string) error {
 	if len(tags) < 2 {
 		return ErrEncodingInvalidTag
 	}
-	e.Resource.Meta[tags[1]] = v.Interface()
-	return nil
+	return e.Resource.Meta.AddMeta(tags[1], v.Interface())
 }
 
 func valueToString(v reflect.Value) (string, error) {
@@ -243,7 +585,8 @@ func valueToString(v reflect.Value) (string, error) {
 }
 
 // populateStruct will browse a given value v and replace every field marked
-// with `jsonapi:"value"` with the value i. Is recursive.
+// with `jsonapi:"value"` with the value i. Is recursive. The value v must be
+// addressable for its fields to be set.
 func populateStruct(v, i reflect.Value) error {
 	if v.Kind() == reflect.Struct {
 		t := v.Type()
@@ -262,14 +605,29 @@ func populateField(f reflect.StructField, v, i reflect.Value) error {
 	// If the type of the value is a pointer or a struct, we can go deeper
 	switch v.Kind() {
 	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
 		return populateField(f, v.Elem(), i)
 	case reflect.Struct:
 		return populateStruct(v, i)
 	}
 
 	if f.Tag.Get("jsonapi") == TagValue {
-		if v.CanSet() && i.Type().AssignableTo(v.Type()) {
+		if !v.CanSet() {
+			return ErrCantSet
+		}
+		if i.Type().AssignableTo(v.Type()) {
 			v.Set(i)
+			return nil
+		}
+		if v.Kind() == reflect.String {
+			str, err := valueToString(i)
+			if err != nil {
+				return err
+			}
+			v.SetString(str)
+			return nil
 		}
 		return ErrEncodingInvalidType
 	}
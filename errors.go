@@ -0,0 +1,220 @@
+package tjsonapi
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Error is a struct that represents an error object from the
+// <a href="http://jsonapi.org/format/#error-objects">JSON API</a>.
+// Error implements the error interface, so it can be returned as is.
+type Error struct {
+	ID     string       `json:"id,omitempty"`
+	Links  Links        `json:"links,omitempty"`
+	Status string       `json:"status,omitempty"`
+	Code   string       `json:"code,omitempty"`
+	Title  string       `json:"title,omitempty"`
+	Detail string       `json:"detail,omitempty"`
+	Source *ErrorSource `json:"source,omitempty"`
+	Meta   Meta         `json:"meta,omitempty"`
+}
+
+// ErrorSource is a struct that represents the source member of an error
+// object, containing references to the primary source of the error.
+type ErrorSource struct {
+	Pointer   string `json:"pointer,omitempty"`
+	Parameter string `json:"parameter,omitempty"`
+	Header    string `json:"header,omitempty"`
+}
+
+// NewError allocates, initializes and returns a new Error object.
+func NewError() *Error {
+	return &Error{
+		Links: NewLinks(),
+		Meta:  NewMeta(),
+	}
+}
+
+// Error returns a human-readable representation of the error object, built
+// from its status, title and detail members.
+func (e *Error) Error() string {
+	parts := make([]string, 0, 3)
+	if e.Status != "" {
+		parts = append(parts, e.Status)
+	}
+	if e.Title != "" {
+		parts = append(parts, e.Title)
+	}
+	if e.Detail != "" {
+		parts = append(parts, e.Detail)
+	}
+	if len(parts) == 0 {
+		if e.Code != "" {
+			return e.Code
+		}
+		return "Unknown JSONAPI error"
+	}
+	return strings.Join(parts, ": ")
+}
+
+// SetAboutLink sets the "about" link of the error object, which leads to
+// further details about this particular occurrence of the problem.
+func (e *Error) SetAboutLink(href string) {
+	if e.Links == nil {
+		e.Links = NewLinks()
+	}
+	e.Links.AddLink("about", href)
+}
+
+// SetTypeLink sets the "type" link of the error object, which identifies
+// the type of error that this particular error is an instance of.
+func (e *Error) SetTypeLink(href string) {
+	if e.Links == nil {
+		e.Links = NewLinks()
+	}
+	e.Links.AddLink("type", href)
+}
+
+// Errors is a slice of Error objects, representing the errors member of a
+// top-level document. Errors implements the error interface, so a whole
+// error document can be returned as a single error.
+type Errors []*Error
+
+// Error returns the messages of every error object, separated by semicolons.
+func (e Errors) Error() string {
+	messages := make([]string, len(e))
+	for it, err := range e {
+		messages[it] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Status returns the HTTP status code applying to the error objects as a
+// whole: their status if they all share the same one, 400 Bad Request if
+// they are all client errors, and 500 Internal Server Error otherwise.
+// Error objects without status are ignored.
+func (e Errors) Status() int {
+	status := 0
+	for _, err := range e {
+		code, _ := strconv.Atoi(err.Status)
+		switch {
+		case code == 0:
+			continue
+		case status == 0 || status == code:
+			status = code
+		case status >= 400 && status < 500 && code >= 400 && code < 500:
+			status = http.StatusBadRequest
+		default:
+			status = http.StatusInternalServerError
+		}
+	}
+	if status < 400 || status >= 600 {
+		return http.StatusInternalServerError
+	}
+	return status
+}
+
+// Unwrap returns the error objects as a slice of errors, allowing errors.As
+// to find a specific *Error in the list.
+func (e Errors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for it, err := range e {
+		errs[it] = err
+	}
+	return errs
+}
+
+// ErrorList is a list of errors, returned by Marshal and Unmarshal when the
+// Context collects errors instead of stopping at the first one.
+// The errors of the list can be matched with errors.Is and errors.As.
+type ErrorList []error
+
+// Error returns the messages of every error, separated by semicolons.
+func (l ErrorList) Error() string {
+	messages := make([]string, len(l))
+	for it, err := range l {
+		messages[it] = err.Error()
+	}
+	return strings.Join(messages, "; ")
+}
+
+// Unwrap returns the errors of the list.
+func (l ErrorList) Unwrap() []error {
+	return l
+}
+
+// JSONAPIErrors converts every error of the list to an Error object, to be
+// used as the errors member of a document.
+func (l ErrorList) JSONAPIErrors() Errors {
+	errs := make(Errors, 0, len(l))
+	for _, err := range l {
+		errs = append(errs, errorObjects(err)...)
+	}
+	return errs
+}
+
+// appendError appends err to the list, flattening it if it's a list itself.
+func (l ErrorList) appendError(err error) ErrorList {
+	switch e := err.(type) {
+	case nil:
+		return l
+	case ErrorList:
+		return append(l, e...)
+	}
+	return append(l, err)
+}
+
+// err returns the list as an error, or nil if it is empty.
+func (l ErrorList) err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// errorObjects converts an error to Error objects. Errors that can't be
+// converted are given the status code of the first error of errorStatuses
+// they match, and are reported as internal server errors otherwise. The
+// message of an internal server error isn't given as its detail, since it
+// could disclose details of the server.
+func errorObjects(err error) Errors {
+	switch e := err.(type) {
+	case *Error:
+		return Errors{e}
+	case Errors:
+		return e
+	case ErrorList:
+		return e.JSONAPIErrors()
+	case interface{ JSONAPIError() *Error }:
+		return Errors{e.JSONAPIError()}
+	}
+
+	var converter interface{ JSONAPIError() *Error }
+	if errors.As(err, &converter) {
+		return Errors{converter.JSONAPIError()}
+	}
+	var object *Error
+	if errors.As(err, &object) {
+		return Errors{object}
+	}
+
+	object = NewError()
+	object.Status = strconv.Itoa(http.StatusInternalServerError)
+	for _, status := range errorStatuses {
+		if status.Match(err) {
+			object.Status = strconv.Itoa(status.Status)
+			if status.Header != "" {
+				object.Source = &ErrorSource{Header: status.Header}
+			}
+			break
+		}
+	}
+	code, _ := strconv.Atoi(object.Status)
+	object.Title = http.StatusText(code)
+	if code < http.StatusInternalServerError {
+		object.Detail = err.Error()
+	}
+	return Errors{object}
+}
@@ -0,0 +1,144 @@
+package tjsonapi
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// fieldPlan is the compiled form of a struct member marked with a jsonapi
+// tag, computed once per struct type.
+type fieldPlan struct {
+	// Index is the index of the member in its struct, and Field the member
+	// itself.
+	Index int
+	Field reflect.StructField
+
+	// Tags is the jsonapi tag of the member, split on commas. Kind, Key and
+	// Sub are respectively its first, second and third values, when present.
+	Tags []string
+	Kind string
+	Key  string
+	Sub  string
+
+	// TypeName is the resource type of identifier members, and of data and
+	// embed relationship members.
+	TypeName string
+
+	// Member is the name of the resource object member the struct member
+	// maps to, as a relative JSON Pointer.
+	Member string
+
+	// ToString converts the value of identifier members to a string.
+	ToString func(reflect.Value) (string, error)
+}
+
+// typePlan is the compiled form of a struct type, listing the members marked
+// with a jsonapi tag.
+type typePlan struct {
+	Type   reflect.Type
+	Fields []*fieldPlan
+
+	// Identifier is the identifier member of the struct, if any.
+	Identifier *fieldPlan
+
+	// Data is the index of the member marked with the data tag of a document
+	// struct, or -1 if the struct isn't a document struct.
+	Data int
+
+	// Members contains the names of the attribute and relationship members
+	// mapped by the struct, as relative JSON Pointers.
+	Members map[string]bool
+}
+
+// typePlans caches the plans of every struct type marshaled or unmarshaled,
+// as a map from reflect.Type to *typePlan.
+var typePlans sync.Map
+
+// planFor returns the plan of the struct type t, compiling it if it's the
+// first time the type is used.
+func planFor(t reflect.Type) *typePlan {
+	if plan, cached := typePlans.Load(t); cached {
+		return plan.(*typePlan)
+	}
+	plan, _ := typePlans.LoadOrStore(t, compilePlan(t))
+	return plan.(*typePlan)
+}
+
+func compilePlan(t reflect.Type) *typePlan {
+	plan := &typePlan{
+		Type:    t,
+		Data:    -1,
+		Members: make(map[string]bool),
+	}
+	for it := 0; it < t.NumField(); it++ {
+		f := t.Field(it)
+		tag, hasTag := f.Tag.Lookup("jsonapi")
+		if !hasTag {
+			continue
+		}
+		tags := strings.Split(tag, ",")
+		field := &fieldPlan{
+			Index: it,
+			Field: f,
+			Tags:  tags,
+			Kind:  tags[0],
+		}
+		if len(tags) > 1 {
+			field.Key = tags[1]
+			field.Member = memberName(tags)
+		}
+		if len(tags) > 2 {
+			field.Sub = tags[2]
+		}
+
+		switch field.Kind {
+		case TagData:
+			if plan.Data < 0 {
+				plan.Data = it
+			}
+		case TagIdentifier:
+			field.TypeName = field.Key
+			field.ToString = stringConverter(f.Type)
+			if plan.Identifier == nil {
+				plan.Identifier = field
+			}
+		case TagAttribute:
+			if field.Key != "" {
+				plan.Members[field.Member] = true
+			}
+		case TagRelationship:
+			if len(tags) > 3 {
+				field.TypeName = tags[3]
+			}
+			if field.Key != "" {
+				plan.Members[field.Member] = true
+			}
+		}
+		plan.Fields = append(plan.Fields, field)
+	}
+	return plan
+}
+
+// stringConverter returns a function converting values of type t to
+// strings, equivalent to valueToString but without inspecting the kind of
+// the value for every call.
+func stringConverter(t reflect.Type) func(reflect.Value) (string, error) {
+	switch t.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(v reflect.Value) (string, error) {
+			return strconv.FormatInt(v.Int(), 10), nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32,
+		reflect.Uint64, reflect.Uintptr:
+		return func(v reflect.Value) (string, error) {
+			return strconv.FormatUint(v.Uint(), 10), nil
+		}
+	case reflect.String:
+		return func(v reflect.Value) (string, error) {
+			return v.String(), nil
+		}
+	}
+	return valueToString
+}
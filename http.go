@@ -0,0 +1,264 @@
+package tjsonapi
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrUnsupportedMediaType is an error object returned when a request
+	// body isn't a JSON API document, or when its media type is modified by
+	// parameters or extensions that the server doesn't support.
+	ErrUnsupportedMediaType = errors.New("Unsupported media type")
+	// ErrNotAcceptable is an error object returned when none of the media
+	// types accepted by a request are supported by the server.
+	ErrNotAcceptable = errors.New("None of the accepted media types " +
+		"is supported")
+)
+
+const (
+	// MediaType is the media type of
+	// <a href="http://jsonapi.org/format/#content-negotiation">JSON API</a>
+	// documents.
+	MediaType = "application/vnd.api+json"
+)
+
+// negotiationKey is the key of the negotiated MediaTypeParams in request
+// contexts.
+type negotiationKey struct{}
+
+// MediaTypeParams is a struct that represents the ext and profile parameters
+// of the JSON API media type, each holding a list of URIs.
+type MediaTypeParams struct {
+	Ext     []string
+	Profile []string
+}
+
+// ParseMediaType parses a media type, as found in the Content-Type header,
+// and returns its parameters.
+// ErrUnsupportedMediaType is returned if it isn't the JSON API media type or
+// if it has parameters other than ext and profile.
+func ParseMediaType(value string) (*MediaTypeParams, error) {
+	m, _, err := parseMediaRange(value)
+	if err != nil {
+		return nil, err
+	}
+	if m == nil {
+		return nil, ErrUnsupportedMediaType
+	}
+	return m, nil
+}
+
+// parseMediaRange parses a media range, as found in the Accept header, and
+// returns its parameters and its quality. The returned parameters are nil if
+// the media range is a wildcard matching the JSON API media type.
+func parseMediaRange(value string) (*MediaTypeParams, float64, error) {
+	mediaType, params, err := mime.ParseMediaType(value)
+	if err != nil {
+		return nil, 0, ErrUnsupportedMediaType
+	}
+	quality := 1.0
+	if q, ok := params["q"]; ok {
+		quality, err = strconv.ParseFloat(q, 64)
+		if err != nil {
+			return nil, 0, ErrUnsupportedMediaType
+		}
+		delete(params, "q")
+	}
+	switch mediaType {
+	case "*/*", "application/*":
+		return nil, quality, nil
+	case MediaType:
+	default:
+		return nil, 0, ErrUnsupportedMediaType
+	}
+	m := new(MediaTypeParams)
+	for key, param := range params {
+		switch key {
+		case "ext":
+			m.Ext = strings.Fields(param)
+		case "profile":
+			m.Profile = strings.Fields(param)
+		default:
+			return nil, 0, ErrUnsupportedMediaType
+		}
+	}
+	return m, quality, nil
+}
+
+// String returns the JSON API media type, with the ext and profile
+// parameters if they are not empty.
+func (m *MediaTypeParams) String() string {
+	params := make(map[string]string)
+	if len(m.Ext) > 0 {
+		params["ext"] = strings.Join(m.Ext, " ")
+	}
+	if len(m.Profile) > 0 {
+		params["profile"] = strings.Join(m.Profile, " ")
+	}
+	return mime.FormatMediaType(MediaType, params)
+}
+
+// NegotiatedMediaType returns the media type parameters negotiated by a
+// Negotiator for the request whose context is ctx, or nil if the request
+// didn't go through a Negotiator.
+func NegotiatedMediaType(ctx context.Context) *MediaTypeParams {
+	m, _ := ctx.Value(negotiationKey{}).(*MediaTypeParams)
+	return m
+}
+
+// Negotiator is a struct enforcing the
+// <a href="http://jsonapi.org/format/#content-negotiation-servers">content
+// negotiation</a> rules of the JSON API on HTTP requests.
+// Extensions and Profiles hold the URIs of the extensions and profiles
+// supported by the server.
+type Negotiator struct {
+	Extensions []string
+	Profiles   []string
+}
+
+// NewNegotiator allocates and initializes a new Negotiator object supporting
+// no extensions and no profiles.
+func NewNegotiator() *Negotiator {
+	return new(Negotiator)
+}
+
+// Negotiate returns a middleware enforcing content negotiation with a
+// Negotiator supporting no extensions and no profiles.
+func Negotiate(next http.Handler) http.Handler {
+	return NewNegotiator().Handler(next)
+}
+
+// Handler returns a middleware enforcing content negotiation before calling
+// next. Requests whose Content-Type isn't supported are answered with a 415
+// status code, and requests whose Accept header doesn't contain a supported
+// media type are answered with a 406 status code, both with an error
+// document. Otherwise the response Content-Type is set to the negotiated
+// media type, which next can retrieve with NegotiatedMediaType.
+func (n *Negotiator) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		if err := n.checkContentType(r.Header.Get("Content-Type")); err != nil {
+			WriteErrors(w, err)
+			return
+		}
+		m, err := n.negotiate(r.Header.Values("Accept"))
+		if err != nil {
+			WriteErrors(w, err)
+			return
+		}
+		w.Header().Set("Content-Type", m.String())
+		ctx := context.WithValue(r.Context(), negotiationKey{}, m)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// checkContentType checks that a request Content-Type is either empty or the
+// JSON API media type with supported extensions.
+func (n *Negotiator) checkContentType(value string) error {
+	if value == "" {
+		return nil
+	}
+	m, err := ParseMediaType(value)
+	if err != nil {
+		return err
+	}
+	if !contains(n.Extensions, m.Ext) {
+		return ErrUnsupportedMediaType
+	}
+	return nil
+}
+
+// negotiate picks the media type of the response from the values of the
+// Accept header. Instances of the JSON API media type with unsupported
+// parameters or extensions are ignored, and the acceptable instance with
+// the highest quality is picked, keeping only the supported profiles.
+func (n *Negotiator) negotiate(values []string) (*MediaTypeParams, error) {
+	var ranges []string
+	for _, value := range values {
+		ranges = append(ranges, splitHeader(value)...)
+	}
+	if len(ranges) == 0 {
+		return new(MediaTypeParams), nil
+	}
+
+	var best *MediaTypeParams
+	bestQuality := 0.0
+	for _, value := range ranges {
+		m, quality, err := parseMediaRange(value)
+		if err != nil || quality <= bestQuality {
+			continue
+		}
+		if m == nil {
+			m = new(MediaTypeParams)
+		}
+		if !contains(n.Extensions, m.Ext) {
+			continue
+		}
+		best, bestQuality = m, quality
+	}
+	if best == nil {
+		return nil, ErrNotAcceptable
+	}
+
+	profiles := best.Profile[:0:0]
+	for _, profile := range best.Profile {
+		if contains(n.Profiles, []string{profile}) {
+			profiles = append(profiles, profile)
+		}
+	}
+	best.Profile = profiles
+	return best, nil
+}
+
+// contains returns whether or not every value of values is in set.
+func contains(set []string, values []string) bool {
+	for _, value := range values {
+		found := false
+		for _, member := range set {
+			if member == value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// splitHeader splits a comma separated header value, ignoring the commas
+// found in quoted strings.
+func splitHeader(value string) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for it := 0; it < len(value); it++ {
+		switch value[it] {
+		case '\\':
+			it++
+		case '"':
+			quoted = !quoted
+		case ',':
+			if !quoted {
+				parts = appendHeaderPart(parts, value[start:it])
+				start = it + 1
+			}
+		}
+	}
+	return appendHeaderPart(parts, value[start:])
+}
+
+// appendHeaderPart appends a trimmed header part to parts if it's not empty.
+func appendHeaderPart(parts []string, part string) []string {
+	part = strings.TrimSpace(part)
+	if part == "" {
+		return parts
+	}
+	return append(parts, part)
+}
@@ -0,0 +1,226 @@
+package tjsonapi
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+// DecodeLinkage decodes the resource linkage sent as the body of an HTTP
+// request to a relationship endpoint. This function is equivalent to calling
+// DecodeLinkage on a blank Context.
+// See Context.DecodeLinkage for more details.
+func DecodeLinkage(r *http.Request, model interface{}, name string,
+	ids interface{}) error {
+	c := new(Context)
+	return c.DecodeLinkage(r, model, name, ids)
+}
+
+// DecodeLinkage decodes the resource linkage sent as the body of an HTTP
+// request to the endpoint of the relationship of the given name of model,
+// using c as the Context. The identifiers of the linkage are stored in the
+// value pointed to by ids, which must be a slice for to-many relationships,
+// and a single value for to-one relationships. A null linkage sets this value
+// to its zero value.
+// The linkage must have the type of the relationship tag of model, the
+// request being checked the same way DecodeRequest does.
+func (c *Context) DecodeLinkage(r *http.Request, model interface{},
+	name string, ids interface{}) error {
+	f := relationshipField(resourceStructType(reflect.TypeOf(model)), name)
+	if f == nil || f.TypeName == "" {
+		return ErrDecodingInvalidTag
+	}
+	v := reflect.ValueOf(ids)
+	if v.Kind() != reflect.Ptr || v.IsNil() {
+		return ErrDecodingInvalidType
+	}
+
+	body, err := c.requestBody(r)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	var document struct {
+		Data json.RawMessage `json:"data"`
+	}
+	if err := json.NewDecoder(body).Decode(&document); errors.Is(err, io.EOF) {
+		return ErrDecodingNoData
+	} else if err != nil {
+		return err
+	}
+	if document.Data == nil {
+		return ErrDecodingNoData
+	}
+
+	v = v.Elem()
+	if firstByte(document.Data) == 'n' {
+		v.Set(reflect.Zero(v.Type()))
+		return nil
+	}
+	var linkage ResourceLinkage
+	if err := json.Unmarshal(document.Data, &linkage); err != nil {
+		return err
+	}
+	return c.decodeLinkage(&linkage, f.TypeName, v)
+}
+
+// decodeLinkage stores the identifiers of the linkage in v, checking that
+// they have the given type.
+func (c *Context) decodeLinkage(linkage *ResourceLinkage, typ string,
+	v reflect.Value) error {
+	isSlice := v.Kind() == reflect.Slice
+	if isSlice != (linkage.Type == ResourceLinkageToMany) {
+		expected, actual := "object", "array"
+		if isSlice {
+			expected, actual = actual, expected
+		}
+		return &DecodeError{
+			Pointer:  "/data",
+			Expected: expected,
+			Actual:   actual,
+			Err:      ErrResourceLinkageBadType,
+		}
+	}
+
+	d := &decoder{Context: c}
+	decode := func(identifier *ResourceIdentifier, v reflect.Value,
+		pointer string) error {
+		if identifier == nil || !typeMatches(typ, identifier.Type) {
+			actual := ""
+			if identifier != nil {
+				actual = identifier.Type
+			}
+			return &DecodeError{
+				Pointer:  pointer + "/type",
+				Expected: typ,
+				Actual:   actual,
+				Err:      ErrDecodingInvalidIDType,
+			}
+		}
+		if err := d.lenient(stringToValue(identifier.ID, v)); err != nil {
+			return &DecodeError{
+				Pointer:  pointer + "/id",
+				Expected: v.Type().String(),
+				Actual:   "string",
+				Err:      err,
+			}
+		}
+		return nil
+	}
+
+	if !isSlice {
+		if v.Kind() == reflect.Ptr {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decode(linkage.Data[0], v, "/data")
+	}
+	v.Set(reflect.MakeSlice(v.Type(), len(linkage.Data), len(linkage.Data)))
+	var errs ErrorList
+	for it, identifier := range linkage.Data {
+		err := decode(identifier, v.Index(it), "/data/"+strconv.Itoa(it))
+		if err != nil {
+			if !c.CollectErrors {
+				return err
+			}
+			errs = errs.appendError(err)
+		}
+	}
+	return errs.err()
+}
+
+// LinkageDiff is a struct describing the changes made to a to-many
+// relationship by a request to its endpoint. Added and Removed hold the
+// identifiers added to and removed from the relationship, and Result holds
+// the identifiers of the relationship once changed. They are slices of the
+// type of the identifiers given to DiffLinkage.
+type LinkageDiff struct {
+	Added   interface{}
+	Removed interface{}
+	Result  interface{}
+}
+
+// DiffLinkage computes the changes requested to a to-many relationship with
+// the given method: POST adds the requested identifiers to the current ones,
+// DELETE removes them, and PATCH replaces the current identifiers with them.
+// Identifiers are compared by their string representation, and current and
+// requested must be slices of the same type. ErrMethodNotAllowed is returned
+// for other methods.
+func DiffLinkage(method string, current,
+	requested interface{}) (*LinkageDiff, error) {
+	cur, req := reflect.ValueOf(current), reflect.ValueOf(requested)
+	if cur.Kind() != reflect.Slice || cur.Type() != req.Type() {
+		return nil, ErrEncodingInvalidType
+	}
+	currentKeys, err := linkageKeys(cur)
+	if err != nil {
+		return nil, err
+	}
+	requestedKeys, err := linkageKeys(req)
+	if err != nil {
+		return nil, err
+	}
+	inCurrent := func(key string) bool { return currentKeys[key] }
+	inRequested := func(key string) bool { return requestedKeys[key] }
+	not := func(in func(string) bool) func(string) bool {
+		return func(key string) bool { return !in(key) }
+	}
+	all := func(string) bool { return true }
+
+	none := reflect.MakeSlice(cur.Type(), 0, 0)
+	var added, removed, result reflect.Value
+	switch method {
+	case http.MethodPost:
+		added = filterLinkage(req, not(inCurrent))
+		removed = none
+		result = reflect.AppendSlice(filterLinkage(cur, all), added)
+	case http.MethodDelete:
+		added = none
+		removed = filterLinkage(cur, inRequested)
+		result = filterLinkage(cur, not(inRequested))
+	case http.MethodPatch:
+		added = filterLinkage(req, not(inCurrent))
+		removed = filterLinkage(cur, not(inRequested))
+		result = filterLinkage(req, all)
+	default:
+		return nil, ErrMethodNotAllowed
+	}
+	return &LinkageDiff{
+		Added:   added.Interface(),
+		Removed: removed.Interface(),
+		Result:  result.Interface(),
+	}, nil
+}
+
+// linkageKeys returns the set of the string representations of the
+// identifiers of the slice v.
+func linkageKeys(v reflect.Value) (map[string]bool, error) {
+	keys := make(map[string]bool, v.Len())
+	for it := 0; it < v.Len(); it++ {
+		key, err := valueToString(v.Index(it))
+		if err != nil {
+			return nil, err
+		}
+		keys[key] = true
+	}
+	return keys, nil
+}
+
+// filterLinkage returns a new slice holding the identifiers of the slice v
+// whose string representation is kept by keep, without duplicates.
+func filterLinkage(v reflect.Value, keep func(key string) bool) reflect.Value {
+	filtered := reflect.MakeSlice(v.Type(), 0, v.Len())
+	seen := make(map[string]bool, v.Len())
+	for it := 0; it < v.Len(); it++ {
+		// Identifiers were already converted by linkageKeys.
+		key, _ := valueToString(v.Index(it))
+		if seen[key] || !keep(key) {
+			continue
+		}
+		seen[key] = true
+		filtered = reflect.Append(filtered, v.Index(it))
+	}
+	return filtered
+}
@@ -19,10 +19,38 @@ var (
 	ErrLinkNoMeta = errors.New("Link has no meta object")
 )
 
+const (
+	// LinkSelf is the key of the link identifying the current document or
+	// resource.
+	LinkSelf = "self"
+
+	// LinkRelated is the key of the link to the related resources of a
+	// relationship or document.
+	LinkRelated = "related"
+
+	// LinkDescribedBy is the key of the link to a description document of
+	// the current document.
+	LinkDescribedBy = "describedby"
+
+	// LinkFirst is the key of the pagination link to the first page.
+	LinkFirst = "first"
+
+	// LinkLast is the key of the pagination link to the last page.
+	LinkLast = "last"
+
+	// LinkPrev is the key of the pagination link to the previous page.
+	LinkPrev = "prev"
+
+	// LinkNext is the key of the pagination link to the next page.
+	LinkNext = "next"
+)
+
 // Link is a struct that represents a link object from the
 // <a href="http://jsonapi.org/format/#document-links">JSON API</a>.
+// When a Link is used as a context link, its HRef is set to the value of the
+// member marked with the `jsonapi:"link,[key],context"` tag.
 type Link struct {
-	HRef string                 `json:"href"`
+	HRef string                 `json:"href" jsonapi:"value"`
 	Meta map[string]interface{} `json:"meta"`
 }
 
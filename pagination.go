@@ -0,0 +1,150 @@
+package tjsonapi
+
+import (
+	"net/url"
+	"strconv"
+)
+
+// Pagination is a struct describing the page of a collection being
+// marshaled, from which the
+// <a href="http://jsonapi.org/format/#fetching-pagination">pagination
+// links</a> of the document are generated.
+// URL is the URL of the request, whose query parameters are kept in every
+// link. The strategy follows the parameters found in Page: cursors when
+// Page.Cursor, PrevCursor or NextCursor are set, offsets when Page.Limit is
+// set, and page numbers when Page.Size is set.
+// Total is the total number of resources of the collection, or nil if it is
+// unknown. When it is known and TotalMeta is not empty, it is added to the
+// top-level meta under that key.
+type Pagination struct {
+	URL  *url.URL
+	Page Page
+
+	PrevCursor string
+	NextCursor string
+
+	Total     *int
+	TotalMeta string
+}
+
+// NewPagination allocates and initializes a new Pagination object for the
+// given request URL and page, with an unknown total written to the "total"
+// meta member once set.
+func NewPagination(u *url.URL, page Page) *Pagination {
+	return &Pagination{
+		URL:       u,
+		Page:      page,
+		TotalMeta: "total",
+	}
+}
+
+// SetTotal sets the total number of resources of the collection.
+func (p *Pagination) SetTotal(total int) {
+	p.Total = &total
+}
+
+// Links returns the pagination links of a page holding count resources, or
+// nil if the Pagination has no URL.
+// When the total is unknown, a next link is generated as long as the page is
+// full, and no last link is generated.
+func (p *Pagination) Links(count int) Links {
+	if p.URL == nil {
+		return nil
+	}
+	links := NewLinks()
+	links.AddLink(LinkSelf, p.URL.String())
+
+	switch {
+	case p.Page.Cursor != "" || p.PrevCursor != "" || p.NextCursor != "":
+		links.AddLink(LinkFirst, p.link("cursor", ""))
+		if p.PrevCursor != "" {
+			links.AddLink(LinkPrev, p.link("cursor", p.PrevCursor))
+		}
+		if p.NextCursor != "" {
+			links.AddLink(LinkNext, p.link("cursor", p.NextCursor))
+		}
+	case p.Page.Limit > 0:
+		limit, offset := p.Page.Limit, p.Page.Offset
+		links.AddLink(LinkFirst, p.link("offset", "0"))
+		if offset > 0 {
+			prev := offset - limit
+			if prev < 0 {
+				prev = 0
+			}
+			links.AddLink(LinkPrev, p.link("offset", strconv.Itoa(prev)))
+		}
+		if p.hasNext(offset+limit, count, limit) {
+			links.AddLink(LinkNext,
+				p.link("offset", strconv.Itoa(offset+limit)))
+		}
+		if p.Total != nil {
+			last := 0
+			if *p.Total > 0 {
+				last = (*p.Total - 1) / limit * limit
+			}
+			links.AddLink(LinkLast, p.link("offset", strconv.Itoa(last)))
+		}
+	case p.Page.Size > 0:
+		size, number := p.Page.Size, p.Page.Number
+		if number < 1 {
+			number = 1
+		}
+		links.AddLink(LinkFirst, p.link("number", "1"))
+		if number > 1 {
+			links.AddLink(LinkPrev, p.link("number", strconv.Itoa(number-1)))
+		}
+		if p.hasNext(number*size, count, size) {
+			links.AddLink(LinkNext, p.link("number", strconv.Itoa(number+1)))
+		}
+		if p.Total != nil {
+			last := 1
+			if *p.Total > 0 {
+				last = (*p.Total + size - 1) / size
+			}
+			links.AddLink(LinkLast, p.link("number", strconv.Itoa(last)))
+		}
+	}
+	return links
+}
+
+// hasNext returns whether or not a page starts at the given position, based
+// on the total if it is known, and on the page being full otherwise.
+func (p *Pagination) hasNext(next, count, size int) bool {
+	if p.Total != nil {
+		return next < *p.Total
+	}
+	return count >= size
+}
+
+// link returns the request URL with the given page parameter set to value,
+// or removed if value is empty.
+func (p *Pagination) link(param, value string) string {
+	u := *p.URL
+	query := u.Query()
+	if value == "" {
+		query.Del(QueryPage + "[" + param + "]")
+	} else {
+		query.Set(QueryPage+"["+param+"]", value)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// encode adds the pagination links of a page holding count resources to the
+// top-level links of the root, and the total to its top-level meta.
+func (p *Pagination) encode(root *Root, count int) {
+	if links := p.Links(count); links != nil {
+		if root.Links == nil {
+			root.Links = NewLinks()
+		}
+		for key, link := range links {
+			root.Links[key] = link
+		}
+	}
+	if p.Total != nil && p.TotalMeta != "" {
+		if root.Meta == nil {
+			root.Meta = NewMeta()
+		}
+		root.Meta[p.TotalMeta] = *p.Total
+	}
+}
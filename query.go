@@ -0,0 +1,464 @@
+package tjsonapi
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	// ErrInvalidQueryParameter is an error object returned when a query
+	// parameter of a request doesn't follow the JSON API rules.
+	ErrInvalidQueryParameter = errors.New("Invalid query parameter")
+
+	// ErrInvalidIncludePath is an error object returned when an include
+	// path doesn't lead to embedded relationships of the requested resource.
+	ErrInvalidIncludePath = errors.New("Invalid include path")
+
+	// ErrUnknownQueryField is an error object returned when a sort or filter
+	// parameter refers to a field that isn't an attribute of the requested
+	// resource.
+	ErrUnknownQueryField = errors.New("Unknown field")
+)
+
+const (
+	// QueryInclude is the name of the include query parameter.
+	QueryInclude = "include"
+	// QueryFields is the name of the family of sparse fieldset parameters.
+	QueryFields = "fields"
+	// QuerySort is the name of the sort query parameter.
+	QuerySort = "sort"
+	// QueryPage is the name of the family of pagination parameters.
+	QueryPage = "page"
+	// QueryFilter is the name of the family of filtering parameters.
+	QueryFilter = "filter"
+)
+
+// Query is a struct that represents the query parameters of a request
+// fetching resources, as defined by the
+// <a href="http://jsonapi.org/format/#fetching">JSON API</a>.
+// Parameters that aren't defined by the specification, such as those of
+// extensions, are kept in Other.
+type Query struct {
+	Include   Includes
+	Fieldsets Fieldsets
+	Sort      []SortField
+	Page      Page
+	Filter    *Filter
+	Other     url.Values
+}
+
+// SortField is a struct that represents a field of the sort parameter. The
+// field may be a dot-separated path through relationships.
+type SortField struct {
+	Field      string
+	Descending bool
+}
+
+// String returns the sort field as written in a sort parameter.
+func (f SortField) String() string {
+	if f.Descending {
+		return "-" + f.Field
+	}
+	return f.Field
+}
+
+// Page is a struct that represents the page parameters of a request, which
+// may follow a page-based, an offset-based or a cursor-based strategy.
+// Parameters that are absent are left to their zero value.
+type Page struct {
+	Number int
+	Size   int
+	Offset int
+	Limit  int
+	Cursor string
+}
+
+// Filter is a struct that represents a tree of filter parameters. The values
+// of filter[author][name] are found in the Values of the "name" field of the
+// "author" field of the root filter.
+type Filter struct {
+	Values []string
+	Fields map[string]*Filter
+}
+
+// NewFilter allocates and initializes a new Filter object.
+func NewFilter() *Filter {
+	return &Filter{
+		Fields: make(map[string]*Filter),
+	}
+}
+
+// Get returns the first value of the filter found at the given path, or an
+// empty string if there is none.
+func (f *Filter) Get(path ...string) string {
+	for _, name := range path {
+		if f == nil {
+			return ""
+		}
+		f = f.Fields[name]
+	}
+	if f == nil || len(f.Values) == 0 {
+		return ""
+	}
+	return f.Values[0]
+}
+
+// ParseQuery parses the query parameters of a request. See ParseIncludes and
+// ParseFieldsets for the include and fields parameters.
+func ParseQuery(query url.Values) (*Query, error) {
+	q := &Query{
+		Filter: NewFilter(),
+		Other:  make(url.Values),
+	}
+	var err error
+	if q.Include, err = ParseIncludes(query); err != nil {
+		return nil, err
+	}
+	if q.Fieldsets, err = ParseFieldsets(query); err != nil {
+		return nil, err
+	}
+	for _, param := range sortedKeys(query) {
+		values := query[param]
+		switch {
+		case param == QueryInclude || isFamily(param, QueryFields):
+		case param == QuerySort:
+			err = q.parseSort(values)
+		case isFamily(param, QueryPage):
+			err = q.parsePage(param, values)
+		case isFamily(param, QueryFilter):
+			err = q.parseFilter(param, values)
+		default:
+			q.Other[param] = values
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return q, nil
+}
+
+func (q *Query) parseSort(values []string) error {
+	for _, value := range values {
+		for _, field := range strings.Split(value, ",") {
+			sortField := SortField{Field: field}
+			if strings.HasPrefix(field, "-") {
+				sortField = SortField{Field: field[1:], Descending: true}
+			}
+			if sortField.Field == "" {
+				return &QueryError{QuerySort, ErrInvalidQueryParameter}
+			}
+			q.Sort = append(q.Sort, sortField)
+		}
+	}
+	return nil
+}
+
+func (q *Query) parsePage(param string, values []string) error {
+	path, err := parseFamily(param, QueryPage)
+	if err != nil {
+		return err
+	}
+	if len(path) != 1 || len(values) != 1 {
+		return &QueryError{param, ErrInvalidQueryParameter}
+	}
+	if path[0] == "cursor" {
+		q.Page.Cursor = values[0]
+		return nil
+	}
+
+	var target *int
+	switch path[0] {
+	case "number":
+		target = &q.Page.Number
+	case "size":
+		target = &q.Page.Size
+	case "offset":
+		target = &q.Page.Offset
+	case "limit":
+		target = &q.Page.Limit
+	default:
+		return &QueryError{param, ErrInvalidQueryParameter}
+	}
+	value, err := strconv.Atoi(values[0])
+	if err != nil || value < 0 {
+		return &QueryError{param, ErrInvalidQueryParameter}
+	}
+	*target = value
+	return nil
+}
+
+func (q *Query) parseFilter(param string, values []string) error {
+	path, err := parseFamily(param, QueryFilter)
+	if err != nil {
+		return err
+	}
+	node := q.Filter
+	for _, name := range path {
+		if node.Fields[name] == nil {
+			node.Fields[name] = NewFilter()
+		}
+		node = node.Fields[name]
+	}
+	node.Values = append(node.Values, values...)
+	return nil
+}
+
+// Validate checks the include, sort and filter parameters against v, which
+// can be a struct, a slice of structs or a document struct, or pointers to
+// them. Sort fields must be attributes, possibly of resources related through
+// embedded relationships, as in author.name. Filter paths must lead to
+// embedded relationships or to attributes the same way, any deeper names, like
+// filter[price][gt], being left to the application.
+func (q *Query) Validate(v interface{}) error {
+	t := reflect.TypeOf(v)
+	if err := q.Include.validate(t, ""); err != nil {
+		return err
+	}
+	for _, field := range q.Sort {
+		if !attributePath(t, strings.Split(field.Field, ".")) {
+			return &QueryError{QuerySort,
+				fmt.Errorf("%w: %q", ErrUnknownQueryField, field.Field)}
+		}
+	}
+	return q.Filter.validate(t, QueryFilter)
+}
+
+func (f *Filter) validate(t reflect.Type, param string) error {
+	if f == nil {
+		return nil
+	}
+	for _, name := range sortedKeys(f.Fields) {
+		sub := f.Fields[name]
+		path := param + "[" + name + "]"
+		if related := embeddedType(t, name); related != nil {
+			if err := sub.validate(related, path); err != nil {
+				return err
+			}
+		} else if !attributePath(t, []string{name}) {
+			return &QueryError{path, ErrUnknownQueryField}
+		}
+	}
+	return nil
+}
+
+// attributePath returns whether or not path leads to an attribute of the
+// resources that t refers to, going through embedded relationships.
+func attributePath(t reflect.Type, path []string) bool {
+	for _, name := range path[:len(path)-1] {
+		if t = embeddedType(t, name); t == nil {
+			return false
+		}
+	}
+	t = resourceStructType(t)
+	if t == nil {
+		return false
+	}
+	for _, f := range planFor(t).Fields {
+		if f.Kind == TagAttribute && f.Key == path[len(path)-1] {
+			return true
+		}
+	}
+	return false
+}
+
+// embeddedType returns the type of the member of the resources that t refers
+// to that is tagged as the embedded relationship of the given name, or nil if
+// there is none.
+func embeddedType(t reflect.Type, name string) reflect.Type {
+	t = resourceStructType(t)
+	if t == nil {
+		return nil
+	}
+	for _, f := range planFor(t).Fields {
+		if f.Kind == TagRelationship && f.Key == name &&
+			f.Sub == TagRelationshipEmbed {
+			return f.Field.Type
+		}
+	}
+	return nil
+}
+
+// QueryError is an error type describing which query parameter of a request
+// couldn't be parsed, and why.
+type QueryError struct {
+	Parameter string
+	Err       error
+}
+
+// Error returns the parameter and the underlying error message.
+func (e *QueryError) Error() string {
+	return e.Parameter + ": " + e.Err.Error()
+}
+
+// Unwrap returns the underlying error.
+func (e *QueryError) Unwrap() error {
+	return e.Err
+}
+
+// JSONAPIError converts the query error to a 400 Bad Request Error object,
+// with the parameter as source.
+func (e *QueryError) JSONAPIError() *Error {
+	err := NewError()
+	err.Status = strconv.Itoa(http.StatusBadRequest)
+	err.Title = http.StatusText(http.StatusBadRequest)
+	err.Detail = e.Error()
+	err.Source = &ErrorSource{Parameter: e.Parameter}
+	return err
+}
+
+// Fieldsets is a map from resource types to the names of the attributes and
+// relationships to keep when marshaling resources of that type, as requested
+// with <a href="http://jsonapi.org/format/#fetching-sparse-fieldsets">sparse
+// fieldsets</a>. Resources of types without fieldset keep all their members.
+type Fieldsets map[string][]string
+
+// ParseFieldsets parses the fields[TYPE] parameters of a request query.
+// An empty parameter value requests no members at all.
+func ParseFieldsets(query url.Values) (Fieldsets, error) {
+	fieldsets := make(Fieldsets)
+	for param, values := range query {
+		if !isFamily(param, QueryFields) {
+			continue
+		}
+		path, err := parseFamily(param, QueryFields)
+		if err != nil {
+			return nil, err
+		}
+		if len(path) != 1 {
+			return nil, &QueryError{param, ErrInvalidQueryParameter}
+		}
+		fields := make([]string, 0)
+		for _, value := range values {
+			for _, field := range strings.Split(value, ",") {
+				if field != "" {
+					fields = append(fields, field)
+				}
+			}
+		}
+		fieldsets[path[0]] = fields
+	}
+	return fieldsets, nil
+}
+
+// Allows returns whether or not the member of the given name is kept when
+// marshaling a resource of type typ.
+func (f Fieldsets) Allows(typ, member string) bool {
+	fields, restricted := f[typ]
+	if !restricted {
+		return true
+	}
+	for _, field := range fields {
+		if field == member {
+			return true
+		}
+	}
+	return false
+}
+
+// Includes is a tree of relationship names, representing the relationship
+// paths whose resources are included in a compound document, as requested
+// with the <a href="http://jsonapi.org/format/#fetching-includes">include</a>
+// parameter. A nil subtree includes every relationship below it.
+type Includes map[string]Includes
+
+// ParseIncludes parses the include parameter of a request query, such as
+// include=author,comments.author. A nil Includes is returned when the
+// parameter is absent, and an empty one when its value is empty.
+func ParseIncludes(query url.Values) (Includes, error) {
+	values, present := query[QueryInclude]
+	if !present {
+		return nil, nil
+	}
+	includes := make(Includes)
+	for _, value := range values {
+		if value == "" {
+			continue
+		}
+		for _, path := range strings.Split(value, ",") {
+			node := includes
+			for _, name := range strings.Split(path, ".") {
+				if name == "" {
+					return nil, &QueryError{QueryInclude,
+						fmt.Errorf("%w: %q", ErrInvalidIncludePath, path)}
+				}
+				if node[name] == nil {
+					node[name] = make(Includes)
+				}
+				node = node[name]
+			}
+		}
+	}
+	return includes, nil
+}
+
+// Validate checks that every include path leads to relationships tagged with
+// `jsonapi:"relationship,[key],embed,[type]"`, starting from v, which can be
+// a struct, a slice of structs or a document struct, or pointers to them.
+// Invalid paths are reported as a QueryError on the include parameter.
+func (i Includes) Validate(v interface{}) error {
+	return i.validate(reflect.TypeOf(v), "")
+}
+
+func (i Includes) validate(t reflect.Type, prefix string) error {
+	for _, name := range sortedKeys(i) {
+		path := prefix + name
+		related := embeddedType(t, name)
+		if related == nil {
+			return &QueryError{QueryInclude,
+				fmt.Errorf("%w: %q", ErrInvalidIncludePath, path)}
+		}
+		if err := i[name].validate(related, path+"."); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// String returns the include paths as the value of an include parameter,
+// with the paths sorted and only the longest paths written.
+func (i Includes) String() string {
+	var paths []string
+	for _, name := range sortedKeys(i) {
+		if len(i[name]) == 0 {
+			paths = append(paths, name)
+			continue
+		}
+		for _, sub := range strings.Split(i[name].String(), ",") {
+			paths = append(paths, name+"."+sub)
+		}
+	}
+	sort.Strings(paths)
+	return strings.Join(paths, ",")
+}
+
+// isFamily returns whether or not param is a member of the given family of
+// parameters, such as fields or fields[articles] for the fields family.
+func isFamily(param, family string) bool {
+	return param == family || strings.HasPrefix(param, family+"[")
+}
+
+// parseFamily splits a query parameter of the given family, such as
+// filter[author][name], into the names between brackets. The family name
+// alone returns an empty path.
+func parseFamily(param, family string) ([]string, error) {
+	rest := strings.TrimPrefix(param, family)
+	if rest == param {
+		return nil, &QueryError{param, ErrInvalidQueryParameter}
+	}
+	var path []string
+	for rest != "" {
+		end := strings.IndexByte(rest, ']')
+		if rest[0] != '[' || end < 2 {
+			return nil, &QueryError{param, ErrInvalidQueryParameter}
+		}
+		path = append(path, rest[1:end])
+		rest = rest[end+1:]
+	}
+	return path, nil
+}
@@ -127,14 +127,20 @@ func (l *ResourceLinkage) MarshalJSON() ([]byte, error) {
 // UnmarshalJSON unmarshals JSON data to a ResourceLinkage object.
 // Can fail if the JSON data does not represent an object or an array.
 func (l *ResourceLinkage) UnmarshalJSON(data []byte) error {
-	var linkage ResourceIdentifier
-	if err := json.Unmarshal(data, &linkage); err == nil {
+	switch firstByte(data) {
+	case '{':
+		var linkage ResourceIdentifier
+		if err := json.Unmarshal(data, &linkage); err != nil {
+			return err
+		}
 		l.Type = ResourceLinkageToOne
 		l.Data = []*ResourceIdentifier{&linkage}
 		return nil
-	}
-
-	if err := json.Unmarshal(data, &l.Data); err == nil {
+	case '[':
+		l.Data = nil
+		if err := json.Unmarshal(data, &l.Data); err != nil {
+			return err
+		}
 		l.Type = ResourceLinkageToMany
 		return nil
 	}
@@ -159,6 +165,31 @@ func NewRelationship() *Relationship {
 	}
 }
 
+// relationship is an alias of Relationship without its JSON methods, used to
+// avoid infinite recursion when unmarshaling.
+type relationship Relationship
+
+// UnmarshalJSON unmarshals JSON data to a Relationship object. A null data
+// member is kept as a to-one linkage without identifier, as it is marshaled,
+// so that it can be told apart from a missing one.
+func (r *Relationship) UnmarshalJSON(data []byte) error {
+	aux := struct {
+		*relationship
+		Data json.RawMessage `json:"data"`
+	}{relationship: (*relationship)(r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	r.Data = nil
+	if string(aux.Data) == "null" {
+		r.Data = NewResourceLinkageToOne()
+	} else if len(aux.Data) > 0 {
+		r.Data = new(ResourceLinkage)
+		return r.Data.UnmarshalJSON(aux.Data)
+	}
+	return nil
+}
+
 // Relationships is a map that associates string values with *Relationship
 // values, effectively representing a relationships object as defined in the
 // <a href="http://jsonapi.org/format/#document-resource-object-relationships">
@@ -0,0 +1,143 @@
+package tjsonapi
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+)
+
+const (
+	// DefaultMaxBodySize is the maximum size in bytes of the request bodies
+	// read by DecodeRequest, unless the Context sets another one.
+	DefaultMaxBodySize = 1 << 20
+)
+
+// DecodeRequest decodes the JSON API document sent as the body of an HTTP
+// request to v. This function is equivalent to calling DecodeRequest on a
+// blank Context.
+// See Context.DecodeRequest for more details.
+func DecodeRequest(r *http.Request, v interface{}) error {
+	c := new(Context)
+	return c.DecodeRequest(r, v)
+}
+
+// DecodeRequest decodes the JSON API document sent as the body of an HTTP
+// request to v, using c as the Context.
+// The request must have the JSON API media type as Content-Type, and its
+// body must not exceed the MaxBodySize of the Context. The document must
+// have primary data, whose resources must have the type of the identifier
+// tag of v. Resources may have no id, as when a client creates a resource,
+// in which case the identifier of v is left untouched.
+// Returned errors can be written as is with WriteErrors, resulting in the
+// appropriate 4xx status codes.
+func (c *Context) DecodeRequest(r *http.Request, v interface{}) error {
+	root, err := c.readRequest(r)
+	if err != nil {
+		return err
+	}
+	if err := checkResourceTypes(root.Data, reflect.TypeOf(v)); err != nil {
+		return err
+	}
+	return c.Unmarshal(root, v)
+}
+
+// readRequest checks the media type of an HTTP request and reads its body as
+// a document with primary data.
+func (c *Context) readRequest(r *http.Request) (*Root, error) {
+	body, err := c.requestBody(r)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	root, err := c.NewDecoder(body).DecodeRoot()
+	if errors.Is(err, io.EOF) {
+		return nil, ErrDecodingNoData
+	} else if err != nil {
+		return nil, err
+	}
+	if root.Data == nil || root.Data.isNull() {
+		return nil, ErrDecodingNoData
+	}
+	return root, nil
+}
+
+// requestBody checks the media type of an HTTP request and returns its body,
+// limited to the MaxBodySize of the Context.
+func (c *Context) requestBody(r *http.Request) (io.ReadCloser, error) {
+	if _, err := ParseMediaType(r.Header.Get("Content-Type")); err != nil {
+		return nil, err
+	}
+	if r.Body == nil {
+		return nil, ErrDecodingNoData
+	}
+	limit := c.MaxBodySize
+	if limit == 0 {
+		limit = DefaultMaxBodySize
+	}
+	return http.MaxBytesReader(nil, r.Body, limit), nil
+}
+
+// checkResourceTypes returns a DecodeError located on the type member of the
+// first resource whose type doesn't match the identifier tag of the struct
+// that t points to, either directly, through a slice or through a document
+// struct.
+func checkResourceTypes(data *Resources, t reflect.Type) error {
+	typeName, ok := identifierType(t)
+	if !ok {
+		return nil
+	}
+	for it, resource := range data.Data {
+		if typeMatches(typeName, resource.Type) {
+			continue
+		}
+		pointer := "/data"
+		if data.Type == ResourcesMany {
+			pointer += "/" + strconv.Itoa(it)
+		}
+		return &DecodeError{
+			Pointer:  pointer + "/type",
+			Expected: typeName,
+			Actual:   resource.Type,
+			Err:      ErrDecodingInvalidIDType,
+		}
+	}
+	return nil
+}
+
+// identifierType returns the type of the identifier tag of the struct that t
+// refers to, as returned by resourceStructType.
+func identifierType(t reflect.Type) (string, bool) {
+	t = resourceStructType(t)
+	if t == nil {
+		return "", false
+	}
+	plan := planFor(t)
+	if plan.Identifier == nil || plan.Identifier.TypeName == "" {
+		return "", false
+	}
+	return plan.Identifier.TypeName, true
+}
+
+// resourceStructType returns the struct type of the resources that t refers
+// to, dereferencing pointers, slices and document structs, or nil if t
+// doesn't refer to a struct.
+func resourceStructType(t reflect.Type) reflect.Type {
+	for t != nil {
+		switch t.Kind() {
+		case reflect.Ptr, reflect.Slice, reflect.Array:
+			t = t.Elem()
+		case reflect.Struct:
+			plan := planFor(t)
+			if plan.Data < 0 {
+				return t
+			}
+			t = t.Field(plan.Data).Type
+		default:
+			return nil
+		}
+	}
+	return nil
+}
@@ -23,8 +23,10 @@ const (
 
 // Resource is a struct that represents a resource object from the
 // <a href="http://jsonapi.org/format/#document-resource-objects">JSON API</a>.
+// An empty ID is omitted, as for resources created by a client that lets the
+// server generate their identifier.
 type Resource struct {
-	ID            string        `json:"id"`
+	ID            string        `json:"id,omitempty"`
 	Type          string        `json:"type"`
 	Attributes    Attributes    `json:"attributes,omitempty"`
 	Relationships Relationships `json:"relationships,omitempty"`
@@ -32,6 +34,13 @@ type Resource struct {
 	Meta          Meta          `json:"meta,omitempty"`
 }
 
+// resourceKey identifies a resource object in a document by its type and
+// identifier, as no two resource objects may share both.
+type resourceKey struct {
+	Type string
+	ID   string
+}
+
 // NewResource allocates and initializes a new Resource object, and returns it.
 func NewResource() *Resource {
 	return &Resource{
@@ -49,6 +58,8 @@ func NewResource() *Resource {
 type Resources struct {
 	Type uint8
 	Data []*Resource
+
+	useNumber bool
 }
 
 // NewResourcesOne allocates and initializes a Resources object with
@@ -108,6 +119,12 @@ func (r *Resources) GetResources() ([]*Resource, error) {
 	return nil, ErrResourcesBadType
 }
 
+// isNull returns whether or not the Resources object represents null primary
+// data, which is a "one" object without resource.
+func (r *Resources) isNull() bool {
+	return r.Type == ResourcesOne && (len(r.Data) == 0 || r.Data[0] == nil)
+}
+
 // MarshalJSON marshals a Resources object to JSON. This method is needed
 // because a Resources object is in fact a multi-type object.<br />
 // If there is many resources in the object, the entire slice is marshaled,
@@ -121,17 +138,23 @@ func (r *Resources) MarshalJSON() ([]byte, error) {
 
 // UnmarshalJSON unmarshals JSON data to a Resources object.
 // Can fail if the JSON data does not represent an object or an array.
+// When the Resources object is part of a Root using numbers, the numbers of
+// the resources are decoded as json.Number.
 func (r *Resources) UnmarshalJSON(data []byte) error {
-	// Try to unmarshal to a single object first
-	var resource Resource
-	if err := json.Unmarshal(data, &resource); err == nil {
+	switch firstByte(data) {
+	case '{':
+		var resource Resource
+		if err := decodeJSON(data, &resource, r.useNumber); err != nil {
+			return err
+		}
 		r.Type = ResourcesOne
 		r.Data = []*Resource{&resource}
 		return nil
-	}
-
-	// Try to unmarshal multiple objects this time
-	if err := json.Unmarshal(data, &r.Data); err == nil {
+	case '[':
+		r.Data = nil
+		if err := decodeJSON(data, &r.Data, r.useNumber); err != nil {
+			return err
+		}
 		r.Type = ResourcesMany
 		return nil
 	}
@@ -0,0 +1,121 @@
+package tjsonapi
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+)
+
+// errorStatus associates the errors matched by Match with an HTTP status
+// code, and optionally with the request header that caused them.
+type errorStatus struct {
+	Match  func(err error) bool
+	Status int
+	Header string
+}
+
+// errorStatuses lists the errors of this package and of the standard library
+// that are converted to error objects with a specific status code.
+var errorStatuses = []errorStatus{
+	{isError(ErrUnsupportedMediaType), http.StatusUnsupportedMediaType,
+		"Content-Type"},
+	{isError(ErrNotAcceptable), http.StatusNotAcceptable, "Accept"},
+	{isError(ErrResourceNotFound), http.StatusNotFound, ""},
+	{isError(ErrMethodNotAllowed), http.StatusMethodNotAllowed, ""},
+	{isError(ErrDecodingInvalidIDType), http.StatusConflict, ""},
+	{isError(ErrIDMismatch), http.StatusConflict, ""},
+	{isError(ErrDecodingInvalidValue), http.StatusUnprocessableEntity, ""},
+	{isError(ErrDecodingUnknownMember), http.StatusUnprocessableEntity, ""},
+	{isError(ErrDecodingOverflow), http.StatusUnprocessableEntity, ""},
+	{isError(ErrDecodingNoData), http.StatusBadRequest, ""},
+	{isError(ErrDecodingMalformed), http.StatusBadRequest, ""},
+	{isError(ErrRootDataAndErrors), http.StatusBadRequest, ""},
+	{isError(ErrResourcesBadType), http.StatusBadRequest, ""},
+	{isError(ErrResourceLinkageBadType), http.StatusBadRequest, ""},
+	{isError(ErrAttributeInvalidKey), http.StatusBadRequest, ""},
+	{isError(io.ErrUnexpectedEOF), http.StatusBadRequest, ""},
+	{isError(context.DeadlineExceeded), http.StatusGatewayTimeout, ""},
+	{isErrorType(new(*json.SyntaxError)), http.StatusBadRequest, ""},
+	{isErrorType(new(*json.UnmarshalTypeError)), http.StatusBadRequest, ""},
+	{isErrorType(new(*http.MaxBytesError)), http.StatusRequestEntityTooLarge,
+		""},
+}
+
+// isError returns a function matching the errors wrapping target.
+func isError(target error) func(err error) bool {
+	return func(err error) bool {
+		return errors.Is(err, target)
+	}
+}
+
+// isErrorType returns a function matching the errors wrapping an error of
+// the type pointed to by target.
+func isErrorType(target interface{}) func(err error) bool {
+	return func(err error) bool {
+		return errors.As(err, target)
+	}
+}
+
+// WriteDocument writes root as the body of an HTTP response with the given
+// status code. The Content-Type header is set to the JSON API media type,
+// unless it was already set, for example by a Negotiator.
+// The root is serialized before anything is written, so that the response
+// is left untouched if it can't be serialized. A nil root writes a response
+// without body, as for 204 No Content.
+func WriteDocument(w http.ResponseWriter, status int, root *Root) error {
+	if root == nil {
+		w.WriteHeader(status)
+		return nil
+	}
+	return writeBody(w, status, root)
+}
+
+// writeBody writes v, serialized to JSON, as the body of an HTTP response
+// with the given status code and the JSON API media type.
+func writeBody(w http.ResponseWriter, status int, v interface{}) error {
+	var buf bytes.Buffer
+	if err := json.NewEncoder(&buf).Encode(v); err != nil {
+		return err
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", MediaType)
+	}
+	w.WriteHeader(status)
+	_, err := buf.WriteTo(w)
+	return err
+}
+
+// WriteErrors writes an error document describing errs as the body of an
+// HTTP response. Errors are converted to error objects the same way
+// ErrorList.JSONAPIErrors does, and the status code of the response is
+// chosen with Errors.Status.
+func WriteErrors(w http.ResponseWriter, errs ...error) error {
+	objects := ErrorList(errs).JSONAPIErrors()
+	root := NewRoot()
+	root.Errors = objects
+	return WriteDocument(w, objects.Status(), root)
+}
+
+// WriteData marshals v and writes it as the body of an HTTP response with
+// the given status code. This function is equivalent to calling WriteData
+// on a blank Context.
+func WriteData(w http.ResponseWriter, status int, v interface{}) error {
+	c := new(Context)
+	return c.WriteData(w, status, v)
+}
+
+// WriteData marshals v using c as the Context, and writes it as the body of
+// an HTTP response with the given status code. If v can't be marshaled, an
+// error document is written instead and the marshaling error is returned.
+func (c *Context) WriteData(w http.ResponseWriter, status int,
+	v interface{}) error {
+	root, err := c.Marshal(v)
+	if err != nil {
+		WriteErrors(w, err)
+		return err
+	}
+	return WriteDocument(w, status, root)
+}
@@ -1,14 +1,144 @@
 package tjsonapi
 
+import (
+	"encoding/json"
+	"errors"
+)
+
+var (
+	// ErrRootDataAndErrors is an error object returned when a document
+	// contains both a data member and an errors member, which the JSON API
+	// forbids.
+	ErrRootDataAndErrors = errors.New("The members data and errors must " +
+		"not coexist in the same document")
+)
+
+const (
+	// Version is the version of the JSON API specification implemented by
+	// this package.
+	Version = "1.1"
+)
+
+// JSONAPI is a struct that represents the
+// <a href="http://jsonapi.org/format/#document-jsonapi-object">jsonapi
+// object</a> of a top-level document, describing the server's
+// implementation.
+type JSONAPI struct {
+	Version string   `json:"version,omitempty"`
+	Ext     []string `json:"ext,omitempty"`
+	Profile []string `json:"profile,omitempty"`
+	Meta    Meta     `json:"meta,omitempty"`
+}
+
+// NewJSONAPI allocates and initializes a new JSONAPI object, with Version as
+// version.
+func NewJSONAPI() *JSONAPI {
+	return &JSONAPI{
+		Version: Version,
+		Meta:    NewMeta(),
+	}
+}
+
 // Root is a struct that represents the top-level object of a
 // <a href="http://jsonapi.org/format/#document-top-level">JSON API</a>
 // document.
 type Root struct {
-	Data *Resources `json:"data,omitempty"`
-	Meta Meta       `json:"meta,omitempty"`
+	JSONAPI  *JSONAPI    `json:"jsonapi,omitempty"`
+	Data     *Resources  `json:"data,omitempty"`
+	Errors   Errors      `json:"errors,omitempty"`
+	Meta     Meta        `json:"meta,omitempty"`
+	Links    Links       `json:"links,omitempty"`
+	Included []*Resource `json:"included,omitempty"`
+
+	useNumber bool
 }
 
 // NewRoot allocates a new Root object. Equivalent to new(Root).
 func NewRoot() *Root {
 	return new(Root)
 }
+
+// UseNumber causes the root to decode numbers as json.Number instead of
+// float64 when unmarshaled from JSON, so that they can be unmarshaled to
+// integers without losing precision.
+func (r *Root) UseNumber() {
+	r.useNumber = true
+}
+
+// AddError adds an Error object to the errors member of the root. If the
+// root already contains primary data, an error is returned.
+func (r *Root) AddError(err *Error) error {
+	if r.Data != nil {
+		return ErrRootDataAndErrors
+	}
+	r.Errors = append(r.Errors, err)
+	return nil
+}
+
+// AddIncluded adds a Resource object to the included member of the root,
+// unless a resource with the same type and identifier is already part of
+// the document.
+func (r *Root) AddIncluded(resource *Resource) {
+	key := resourceKey{resource.Type, resource.ID}
+	if r.Data != nil {
+		for _, primary := range r.Data.Data {
+			if primary != nil && key == (resourceKey{primary.Type, primary.ID}) {
+				return
+			}
+		}
+	}
+	for _, included := range r.Included {
+		if key == (resourceKey{included.Type, included.ID}) {
+			return
+		}
+	}
+	r.Included = append(r.Included, resource)
+}
+
+// HasErrors returns whether or not the root is an error document.
+func (r *Root) HasErrors() bool {
+	return len(r.Errors) > 0
+}
+
+// root is an alias of Root without its JSON methods, used to avoid infinite
+// recursion when marshaling.
+type root Root
+
+// MarshalJSON marshals a Root object to JSON. It fails if both the data and
+// the errors members are set.
+func (r *Root) MarshalJSON() ([]byte, error) {
+	if r.Data != nil && len(r.Errors) > 0 {
+		return nil, ErrRootDataAndErrors
+	}
+	return json.Marshal((*root)(r))
+}
+
+// UnmarshalJSON unmarshals JSON data to a Root object. It fails if the
+// document contains both the data and the errors members.
+func (r *Root) UnmarshalJSON(data []byte) error {
+	// The primary data is decoded separately, so that the Resources object
+	// knows whether to use numbers or not.
+	aux := struct {
+		*root
+		Data json.RawMessage `json:"data"`
+	}{root: (*root)(r)}
+	if err := decodeJSON(data, &aux, r.useNumber); err != nil {
+		return err
+	}
+	// A null data member is kept as a single nil resource, as it is
+	// marshaled, so that it can be told apart from a missing one.
+	r.Data = nil
+	if string(aux.Data) == "null" {
+		r.Data = NewResourcesOne()
+	} else if len(aux.Data) > 0 {
+		r.Data = &Resources{useNumber: r.useNumber}
+		if err := r.Data.UnmarshalJSON(aux.Data); err != nil {
+			return err
+		}
+	}
+
+	if r.Data != nil && len(r.Errors) > 0 {
+		return ErrRootDataAndErrors
+	}
+	return nil
+}
@@ -0,0 +1,582 @@
+package tjsonapi
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+var (
+	// ErrResourceNotFound is an error object returned when a requested
+	// resource, or the route leading to it, doesn't exist. Resource handlers
+	// can return it to answer with a 404 status code.
+	ErrResourceNotFound = errors.New("Resource not found")
+
+	// ErrMethodNotAllowed is an error object returned when a route doesn't
+	// support the method of a request.
+	ErrMethodNotAllowed = errors.New("Method not allowed")
+
+	// ErrIDMismatch is an error object returned when the identifier of a
+	// resource sent to update another one doesn't match the URL.
+	ErrIDMismatch = errors.New("Resource identifier doesn't match the URL")
+
+	// ErrInvalidModel is an error object returned when a model registered to
+	// a Router isn't a struct with an identifier tag.
+	ErrInvalidModel = errors.New("Model has no identifier tag")
+)
+
+// ResourceHandler is the interface implemented by the handlers of a resource
+// type registered to a Router. The values returned by its methods are
+// marshaled with the Context of the Router, and may be structs, pointers to
+// structs, slices of structs or document structs.
+//
+// FindAll returns the collection of resources matching the query, which may
+// be wrapped in a Collection to describe its pagination. FindOne returns the
+// resource of the given identifier, a nil value or ErrResourceNotFound
+// resulting in a 404 status code. Create receives a pointer to the struct
+// decoded from the request, and Update a pointer to the resource found by
+// FindOne with the members sent in the request decoded over it. Both return
+// the resource as stored, or nil to answer with 204 No Content. Delete
+// removes the resource of the given identifier.
+// Other errors are written with WriteErrors.
+type ResourceHandler interface {
+	FindAll(r *http.Request, q *Query) (interface{}, error)
+	FindOne(r *http.Request, id string, q *Query) (interface{}, error)
+	Create(r *http.Request, v interface{}) (interface{}, error)
+	Update(r *http.Request, id string, v interface{}) (interface{}, error)
+	Delete(r *http.Request, id string) error
+}
+
+// RelationshipHandler is the interface that resource handlers implement to
+// allow the modification of their to-many relationships through the
+// /{type}/{id}/relationships/{relationship} endpoint. UpdateRelationship
+// receives the changes computed by DiffLinkage for the relationship of the
+// given name of the resource of the given identifier.
+type RelationshipHandler interface {
+	UpdateRelationship(r *http.Request, id, name string,
+		diff *LinkageDiff) error
+}
+
+// Collection is a struct that FindAll can return to describe the page of the
+// collection it found, from which the pagination links of the document are
+// generated. Data holds the resources of the page. Page holds the page
+// actually used when it differs from the one requested, as when a default
+// page size applies. Total, PrevCursor and NextCursor are copied to the
+// Pagination of the document.
+type Collection struct {
+	Data interface{}
+	Page Page
+
+	Total      *int
+	PrevCursor string
+	NextCursor string
+}
+
+// paginate sets the pagination state of the collection to p.
+func (coll *Collection) paginate(p *Pagination) {
+	if coll.Page != (Page{}) {
+		p.Page = coll.Page
+	}
+	p.Total = coll.Total
+	p.PrevCursor = coll.PrevCursor
+	p.NextCursor = coll.NextCursor
+}
+
+// route associates a resource handler with the struct type of its resources.
+type route struct {
+	Type    reflect.Type
+	Name    string
+	Handler ResourceHandler
+}
+
+// Router is an http.Handler exposing the resources of registered handlers
+// through the endpoints of the
+// <a href="http://jsonapi.org/format/#crud">JSON API</a>:
+// /{type}, /{type}/{id}, /{type}/{id}/{relationship} and
+// /{type}/{id}/relationships/{relationship}, below Prefix.
+// Request bodies are decoded and responses encoded with Context, to which the
+// sparse fieldsets, include paths and pagination of each request are added.
+// Content negotiation is left to a Negotiator wrapping the Router.
+type Router struct {
+	Context *Context
+	Prefix  string
+
+	routes map[string]*route
+}
+
+// NewRouter allocates and initializes a new Router object with a new Context
+// and no prefix.
+func NewRouter() *Router {
+	return &Router{
+		Context: NewContext(),
+		routes:  make(map[string]*route),
+	}
+}
+
+// Register registers h as the handler of the resources of the struct type of
+// model, which is routed by the type of its identifier tag.
+func (rt *Router) Register(model interface{}, h ResourceHandler) error {
+	t := resourceStructType(reflect.TypeOf(model))
+	name, ok := identifierType(t)
+	if !ok {
+		return ErrInvalidModel
+	}
+	rt.routes[name] = &route{
+		Type:    t,
+		Name:    name,
+		Handler: h,
+	}
+	return nil
+}
+
+// ServeHTTP dispatches the request to the handler registered for the type
+// found in the URL.
+func (rt *Router) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	if prefix := strings.TrimSuffix(rt.Prefix, "/"); prefix != "" {
+		if path != prefix && !strings.HasPrefix(path, prefix+"/") {
+			WriteErrors(w, ErrResourceNotFound)
+			return
+		}
+		path = path[len(prefix):]
+	}
+	path = strings.Trim(path, "/")
+	segments := strings.Split(path, "/")
+	route := rt.routes[segments[0]]
+	if route == nil {
+		WriteErrors(w, ErrResourceNotFound)
+		return
+	}
+
+	switch {
+	case len(segments) == 1:
+		rt.serveCollection(w, r, route)
+	case len(segments) == 2:
+		rt.serveResource(w, r, route, segments[1])
+	case len(segments) == 3:
+		rt.serveRelated(w, r, route, segments[1], segments[2])
+	case len(segments) == 4 && segments[2] == "relationships":
+		rt.serveRelationship(w, r, route, segments[1], segments[3])
+	default:
+		WriteErrors(w, ErrResourceNotFound)
+	}
+}
+
+// serveCollection serves the /{type} endpoint.
+func (rt *Router) serveCollection(w http.ResponseWriter, r *http.Request,
+	route *route) {
+	c, q, err := rt.requestContext(r, route.Type)
+	if err != nil {
+		WriteErrors(w, err)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		data, err := route.Handler.FindAll(r, q)
+		if err != nil {
+			WriteErrors(w, err)
+			return
+		}
+		if coll, ok := data.(*Collection); ok {
+			coll.paginate(c.Pagination)
+			data = coll.Data
+		}
+		c.WriteData(w, http.StatusOK, data)
+	case http.MethodPost:
+		v := reflect.New(route.Type).Interface()
+		if err := c.DecodeRequest(r, v); err != nil {
+			WriteErrors(w, err)
+			return
+		}
+		created, err := route.Handler.Create(r, v)
+		if err != nil {
+			WriteErrors(w, err)
+			return
+		}
+		if isNil(created) {
+			WriteDocument(w, http.StatusNoContent, nil)
+			return
+		}
+		root, err := c.Marshal(created)
+		if err != nil {
+			WriteErrors(w, err)
+			return
+		}
+		if root.Data != nil && root.Data.Type == ResourcesOne &&
+			len(root.Data.Data) == 1 && root.Data.Data[0] != nil {
+			w.Header().Set("Location",
+				rt.resourcePath(route, root.Data.Data[0].ID))
+		}
+		WriteDocument(w, http.StatusCreated, root)
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost)
+	}
+}
+
+// serveResource serves the /{type}/{id} endpoint.
+func (rt *Router) serveResource(w http.ResponseWriter, r *http.Request,
+	route *route, id string) {
+	c, q, err := rt.requestContext(r, route.Type)
+	if err != nil {
+		WriteErrors(w, err)
+		return
+	}
+
+	var data interface{}
+	switch r.Method {
+	case http.MethodGet:
+		data, err = route.Handler.FindOne(r, id, q)
+		if err == nil && isNil(data) {
+			err = ErrResourceNotFound
+		}
+	case http.MethodPatch:
+		data, err = rt.update(c, r, route, id)
+		if err == nil && isNil(data) {
+			WriteDocument(w, http.StatusNoContent, nil)
+			return
+		}
+	case http.MethodDelete:
+		if err := route.Handler.Delete(r, id); err != nil {
+			WriteErrors(w, err)
+			return
+		}
+		WriteDocument(w, http.StatusNoContent, nil)
+		return
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPatch,
+			http.MethodDelete)
+		return
+	}
+	if err != nil {
+		WriteErrors(w, err)
+		return
+	}
+	c.WriteData(w, http.StatusOK, data)
+}
+
+// update decodes the resource sent to the /{type}/{id} endpoint over the
+// current one, so that the members missing from the request keep their
+// values, checks that its identifier matches the URL and updates it.
+func (rt *Router) update(c *Context, r *http.Request, route *route,
+	id string) (interface{}, error) {
+	root, err := c.readRequest(r)
+	if err != nil {
+		return nil, err
+	}
+	err = checkResourceTypes(root.Data, reflect.PtrTo(route.Type))
+	if err != nil {
+		return nil, err
+	}
+	if root.Data.Type == ResourcesOne && root.Data.Data[0].ID != id {
+		return nil, &DecodeError{
+			Pointer:  "/data/id",
+			Expected: id,
+			Actual:   root.Data.Data[0].ID,
+			Err:      ErrIDMismatch,
+		}
+	}
+	current, err := rt.findOne(r, route, id, nil)
+	if err != nil {
+		return nil, err
+	}
+	v := current.Addr().Interface()
+	if err := c.Unmarshal(root, v); err != nil {
+		return nil, err
+	}
+	return route.Handler.Update(r, id, v)
+}
+
+// serveRelated serves the /{type}/{id}/{relationship} endpoint, whose primary
+// data are the resources related to the resource of the given identifier.
+// Embedded relationships are read from the resource, while relationships
+// holding identifiers are resolved with the handler of their type.
+func (rt *Router) serveRelated(w http.ResponseWriter, r *http.Request,
+	route *route, id, name string) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	f := relationshipField(route.Type, name)
+	if f == nil {
+		WriteErrors(w, ErrResourceNotFound)
+		return
+	}
+	related := f.Field.Type
+	if f.Sub == TagRelationshipData {
+		relatedRoute := rt.routes[f.TypeName]
+		if relatedRoute == nil {
+			WriteErrors(w, ErrResourceNotFound)
+			return
+		}
+		related = relatedRoute.Type
+	}
+	c, _, err := rt.requestContext(r, related)
+	if err != nil {
+		WriteErrors(w, err)
+		return
+	}
+
+	v, err := rt.findOne(r, route, id, Includes{name: nil})
+	if err != nil {
+		WriteErrors(w, err)
+		return
+	}
+	value := v.Field(f.Index)
+	if f.Sub == TagRelationshipData {
+		value, err = rt.resolveIdentifiers(r, rt.routes[f.TypeName], value)
+		if err != nil {
+			WriteErrors(w, err)
+			return
+		}
+	}
+
+	if value.Kind() == reflect.Ptr && value.IsNil() {
+		root := NewRoot()
+		root.Data = NewResourcesOne()
+		c.encodeDocumentMembers(root)
+		WriteDocument(w, http.StatusOK, root)
+		return
+	}
+	c.WriteData(w, http.StatusOK, value.Interface())
+}
+
+// resolveIdentifiers finds the resources whose identifiers are held by v with
+// the handler of route. A single identifier returns a pointer to a struct,
+// which is nil if the resource isn't found, and a slice of identifiers
+// returns a slice of structs, ignoring the resources that aren't found.
+func (rt *Router) resolveIdentifiers(r *http.Request, route *route,
+	v reflect.Value) (reflect.Value, error) {
+	find := func(v reflect.Value) (reflect.Value, error) {
+		id, err := valueToString(v)
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		resource, err := rt.findOne(r, route, id, nil)
+		if errors.Is(err, ErrResourceNotFound) {
+			return reflect.Value{}, nil
+		}
+		return resource, err
+	}
+
+	if v.Kind() != reflect.Slice && v.Kind() != reflect.Array {
+		resource, err := find(v)
+		if err != nil || !resource.IsValid() {
+			return reflect.Zero(reflect.PtrTo(route.Type)), err
+		}
+		ptr := reflect.New(route.Type)
+		ptr.Elem().Set(resource)
+		return ptr, nil
+	}
+	resources := reflect.MakeSlice(reflect.SliceOf(route.Type), 0, v.Len())
+	for it := 0; it < v.Len(); it++ {
+		resource, err := find(v.Index(it))
+		if err != nil {
+			return reflect.Value{}, err
+		}
+		if resource.IsValid() {
+			resources = reflect.Append(resources, resource)
+		}
+	}
+	return resources, nil
+}
+
+// serveRelationship serves the /{type}/{id}/relationships/{relationship}
+// endpoint, whose primary data is the resource linkage of the relationship.
+// To-many relationships can be modified through this endpoint when the
+// handler implements RelationshipHandler, the resulting linkage being written
+// in response.
+func (rt *Router) serveRelationship(w http.ResponseWriter, r *http.Request,
+	route *route, id, name string) {
+	f := relationshipField(route.Type, name)
+	if f == nil {
+		WriteErrors(w, ErrResourceNotFound)
+		return
+	}
+	handler, modifiable := route.Handler.(RelationshipHandler)
+	modifiable = modifiable && f.Field.Type.Kind() == reflect.Slice
+	if r.Method != http.MethodGet && !modifiable {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+
+	v, err := rt.findOne(r, route, id, Includes{name: {}})
+	if err != nil {
+		WriteErrors(w, err)
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost, http.MethodPatch, http.MethodDelete:
+		current, err := linkageIdentifiers(v.Field(f.Index), f)
+		if err != nil {
+			WriteErrors(w, err)
+			return
+		}
+		requested := reflect.New(current.Type())
+		err = rt.Context.DecodeLinkage(r, v.Interface(), name,
+			requested.Interface())
+		if err != nil {
+			WriteErrors(w, err)
+			return
+		}
+		diff, err := DiffLinkage(r.Method, current.Interface(),
+			requested.Elem().Interface())
+		if err == nil {
+			err = handler.UpdateRelationship(r, id, name, diff)
+		}
+		if err == nil {
+			v, err = rt.findOne(r, route, id, Includes{name: {}})
+		}
+		if err != nil {
+			WriteErrors(w, err)
+			return
+		}
+	default:
+		methodNotAllowed(w, http.MethodGet, http.MethodPost, http.MethodPatch,
+			http.MethodDelete)
+		return
+	}
+	rt.writeRelationship(w, r, route, id, name, v.Addr().Interface())
+}
+
+// linkageIdentifiers returns the identifiers held by the to-many relationship
+// member v, as described by f. Relationships holding identifiers are returned
+// as is, while the identifiers of embedded structs are collected in a slice
+// of the type of their identifier member.
+func linkageIdentifiers(v reflect.Value, f *fieldPlan) (reflect.Value, error) {
+	if f.Sub == TagRelationshipData {
+		return v, nil
+	}
+	t := resourceStructType(v.Type())
+	if t == nil || planFor(t).Identifier == nil {
+		return reflect.Value{}, ErrEncodingInvalidType
+	}
+	identifier := planFor(t).Identifier
+	ids := reflect.MakeSlice(reflect.SliceOf(identifier.Field.Type), 0, v.Len())
+	for it := 0; it < v.Len(); it++ {
+		elem := v.Index(it)
+		for elem.Kind() == reflect.Ptr || elem.Kind() == reflect.Interface {
+			if elem.IsNil() {
+				break
+			}
+			elem = elem.Elem()
+		}
+		if elem.Kind() != reflect.Struct {
+			continue
+		}
+		ids = reflect.Append(ids, elem.Field(identifier.Index))
+	}
+	return ids, nil
+}
+
+// writeRelationship writes the relationship of the given name of the
+// resource v as a document whose primary data is its resource linkage.
+func (rt *Router) writeRelationship(w http.ResponseWriter, r *http.Request,
+	route *route, id, name string, v interface{}) {
+	c := *rt.Context
+	c.Fieldsets = nil
+	c.Include = Includes{}
+	c.Pagination = nil
+	root, err := c.Marshal(v)
+	if err != nil {
+		WriteErrors(w, err)
+		return
+	}
+	relationship := root.Data.Data[0].Relationships[name]
+	if relationship == nil {
+		WriteErrors(w, ErrResourceNotFound)
+		return
+	}
+	if relationship.Links == nil {
+		relationship.Links = NewLinks()
+	}
+	relationship.Links.AddLink(LinkSelf, r.URL.String())
+	relationship.Links.AddLink(LinkRelated,
+		rt.resourcePath(route, id)+"/"+name)
+	writeBody(w, http.StatusOK, relationship)
+}
+
+// findOne finds the resource of the given identifier with the handler of
+// route, and returns it as a struct value. The include paths tell the
+// handler which relationships are needed.
+func (rt *Router) findOne(r *http.Request, route *route, id string,
+	include Includes) (reflect.Value, error) {
+	resource, err := route.Handler.FindOne(r, id, &Query{Include: include})
+	if err != nil {
+		return reflect.Value{}, err
+	}
+	if isNil(resource) {
+		return reflect.Value{}, ErrResourceNotFound
+	}
+	v := reflect.Indirect(reflect.ValueOf(resource))
+	if v.Type() != route.Type {
+		return reflect.Value{}, ErrEncodingInvalidType
+	}
+	// The returned struct is copied so that it is addressable.
+	copied := reflect.New(route.Type).Elem()
+	copied.Set(v)
+	return copied, nil
+}
+
+// requestContext parses the query of the request, validates it against the
+// struct type t, and returns a copy of the Context of the Router with the
+// sparse fieldsets, include paths and pagination of the request, and a self
+// link. The pagination only applies to the documents of collections.
+func (rt *Router) requestContext(r *http.Request,
+	t reflect.Type) (*Context, *Query, error) {
+	q, err := ParseQuery(r.URL.Query())
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := q.Validate(reflect.Zero(t).Interface()); err != nil {
+		return nil, nil, err
+	}
+
+	c := *rt.Context
+	c.Fieldsets = q.Fieldsets
+	c.Include = q.Include
+	c.Pagination = NewPagination(r.URL, q.Page)
+	c.DocumentLinks = NewLinks()
+	for key, link := range rt.Context.DocumentLinks {
+		c.DocumentLinks[key] = link
+	}
+	c.DocumentLinks.AddLink(LinkSelf, r.URL.String())
+	return &c, q, nil
+}
+
+// resourcePath returns the path of the resource of the given identifier.
+func (rt *Router) resourcePath(route *route, id string) string {
+	return strings.TrimSuffix(rt.Prefix, "/") + "/" + route.Name + "/" +
+		url.PathEscape(id)
+}
+
+// relationshipField returns the member of the struct type t tagged as the
+// relationship of the given name, if it holds resources or identifiers.
+func relationshipField(t reflect.Type, name string) *fieldPlan {
+	for _, f := range planFor(t).Fields {
+		if f.Kind == TagRelationship && f.Key == name &&
+			(f.Sub == TagRelationshipEmbed || f.Sub == TagRelationshipData) {
+			return f
+		}
+	}
+	return nil
+}
+
+// methodNotAllowed answers a request with a 405 status code, listing the
+// allowed methods.
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	WriteErrors(w, ErrMethodNotAllowed)
+}
+
+// isNil returns whether or not v is nil or a nil pointer.
+func isNil(v interface{}) bool {
+	if v == nil {
+		return true
+	}
+	value := reflect.ValueOf(v)
+	return value.Kind() == reflect.Ptr && value.IsNil()
+}
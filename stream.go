@@ -0,0 +1,603 @@
+package tjsonapi
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+)
+
+// Encoder is a struct writing JSON API documents directly from tagged
+// structs to an output stream, without building a Root first.
+type Encoder struct {
+	Context *Context
+
+	w   io.Writer
+	buf bytes.Buffer
+	enc *json.Encoder
+}
+
+// NewEncoder returns a new Encoder writing to w. This function is equivalent
+// to calling NewEncoder on a blank Context.
+func NewEncoder(w io.Writer) *Encoder {
+	c := new(Context)
+	return c.NewEncoder(w)
+}
+
+// NewEncoder returns a new Encoder writing to w, using c as the Context.
+func (c *Context) NewEncoder(w io.Writer) *Encoder {
+	e := &Encoder{
+		Context: c,
+		w:       w,
+	}
+	e.enc = json.NewEncoder(&e.buf)
+	return e
+}
+
+// Encode writes the JSON API document of v to the stream, followed by a
+// newline character.
+// Besides the values accepted by Context.Marshal, v can be a channel of
+// structs, which is read until closed, or an iterator function of type
+// func(func(T) bool). In both cases, the primary data is a collection.
+// Resources are written to the stream one at a time, so that collections
+// don't need to be held in memory. Only the included resources are kept
+// until the end of the document. If an error occurs, the document written so
+// far is incomplete, and the rest of a channel is drained in the background
+// so that its producer isn't blocked. When the Context collects errors, the
+// resources of a collection that fail to marshal are left out of the
+// document, which is completed, and every error is returned as an
+// ErrorList.
+func (e *Encoder) Encode(i interface{}) error {
+	e.buf.Reset()
+	v := reflect.ValueOf(i)
+	document := reflect.Indirect(v)
+
+	root := NewRoot()
+	if index, isDocument := documentDataField(document); isDocument {
+		if err := encodeDocumentMeta(document, root); err != nil {
+			return err
+		}
+		v = document.Field(index)
+	}
+	e.Context.encodeDocumentMembers(root)
+
+	e.buf.WriteByte('{')
+	if root.JSONAPI != nil {
+		e.buf.WriteString(`"jsonapi":`)
+		if err := e.writeValue(root.JSONAPI); err != nil {
+			return err
+		}
+		e.buf.WriteByte(',')
+	}
+	e.buf.WriteString(`"data":`)
+
+	s := &encoder{
+		Context:  e.Context,
+		Included: newInclusion(),
+		Include:  e.Context.Include,
+		Index:    -1,
+	}
+	primary := make(map[resourceKey]bool)
+	count := 0
+	var err error
+	switch v.Kind() {
+	case reflect.Struct, reflect.Ptr:
+		err = e.writeResource(s, v, primary)
+	case reflect.Array, reflect.Slice:
+		count, err = e.writeCollection(
+			func(yield func(reflect.Value) error) error {
+				for it := 0; it < v.Len(); it++ {
+					if err := yield(v.Index(it)); err != nil {
+						return err
+					}
+				}
+				return nil
+			}, s, primary)
+	case reflect.Chan:
+		count, err = e.writeCollection(
+			func(yield func(reflect.Value) error) error {
+				for {
+					elem, ok := v.Recv()
+					if !ok {
+						return nil
+					}
+					if err := yield(elem); err != nil {
+						go drain(v)
+						return err
+					}
+				}
+			}, s, primary)
+	case reflect.Func:
+		if !isIterator(v.Type()) {
+			return ErrEncodingInvalidType
+		}
+		count, err = e.writeCollection(
+			func(yield func(reflect.Value) error) error {
+				return iterate(v, yield)
+			}, s, primary)
+	default:
+		return ErrEncodingInvalidType
+	}
+	var collected ErrorList
+	if errors.As(err, &collected) && e.Context.CollectErrors &&
+		v.Kind() != reflect.Struct && v.Kind() != reflect.Ptr {
+		// The failing resources were left out, the document is completed.
+		err = nil
+	} else if err != nil {
+		return err
+	}
+	if e.Context.Pagination != nil && v.Kind() != reflect.Struct &&
+		v.Kind() != reflect.Ptr {
+		e.Context.Pagination.encode(root, count)
+	}
+
+	if len(root.Meta) > 0 {
+		e.buf.WriteString(`,"meta":`)
+		if err := e.writeValue(root.Meta); err != nil {
+			return err
+		}
+	}
+	if len(root.Links) > 0 {
+		e.buf.WriteString(`,"links":`)
+		if err := e.writeValue(root.Links); err != nil {
+			return err
+		}
+	}
+	hasIncluded := false
+	for _, resource := range s.Included.Resources {
+		if primary[resourceKey{resource.Type, resource.ID}] {
+			continue
+		}
+		if hasIncluded {
+			e.buf.WriteByte(',')
+		} else {
+			e.buf.WriteString(`,"included":[`)
+			hasIncluded = true
+		}
+		if err := e.writeValue(resource); err != nil {
+			return err
+		}
+	}
+	if hasIncluded {
+		e.buf.WriteByte(']')
+	}
+	e.buf.WriteString("}\n")
+	if err := e.flush(); err != nil {
+		return err
+	}
+	return collected.err()
+}
+
+// writeCollection writes the resources yielded by each as a JSON array, and
+// returns the number of resources written. When the Context collects errors,
+// the resources that fail are left out and their errors are returned as an
+// ErrorList once the array is complete.
+func (e *Encoder) writeCollection(
+	each func(yield func(reflect.Value) error) error, s *encoder,
+	primary map[resourceKey]bool) (int, error) {
+	e.buf.WriteByte('[')
+	count := 0
+	var errs ErrorList
+	err := each(func(v reflect.Value) error {
+		mark := e.buf.Len()
+		if count > 0 {
+			e.buf.WriteByte(',')
+		}
+		s.Index = count + len(errs)
+		if err := e.writeResource(s, v, primary); err != nil {
+			if !e.Context.CollectErrors {
+				return err
+			}
+			e.buf.Truncate(mark)
+			errs = errs.appendError(err)
+			return nil
+		}
+		count++
+		// Every resource is flushed, so that only one resource at a time
+		// is buffered.
+		return e.flush()
+	})
+	if err != nil {
+		return count, err
+	}
+	e.buf.WriteByte(']')
+	return count, errs.err()
+}
+
+// drain receives the values of a channel until it is closed.
+func drain(v reflect.Value) {
+	for {
+		if _, ok := v.Recv(); !ok {
+			return
+		}
+	}
+}
+
+// writeResource writes the resource object of the struct v to the buffer.
+// The attributes are written directly, while the other members are built
+// with the struct encoder.
+func (e *Encoder) writeResource(s *encoder, v reflect.Value,
+	primary map[resourceKey]bool) error {
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ErrEncodingInvalidType
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return ErrEncodingInvalidType
+	}
+
+	// The maps of the resource are reused from one resource to the next,
+	// as they are written before the next resource is encoded.
+	if s.Resource == nil {
+		s.Resource = NewResource()
+	}
+	s.Resource.ID, s.Resource.Type = "", ""
+	for key := range s.Resource.Relationships {
+		delete(s.Resource.Relationships, key)
+	}
+	for key := range s.Resource.Links {
+		delete(s.Resource.Links, key)
+	}
+	for key := range s.Resource.Meta {
+		delete(s.Resource.Meta, key)
+	}
+	var attributes []*fieldPlan
+	var errs ErrorList
+	plan := planFor(v.Type())
+	typ := s.resourceType(plan)
+	for _, f := range plan.Fields {
+		if s.omitted(typ, f) {
+			continue
+		}
+		var err error
+		switch f.Kind {
+		case TagIdentifier:
+			err = s.encodeIdentifier(v.Field(f.Index), f)
+		case TagAttribute:
+			if len(f.Tags) < 2 {
+				err = ErrEncodingInvalidTag
+			} else {
+				err = checkAttribute(f.Key, v.Field(f.Index).Interface())
+				attributes = append(attributes, f)
+			}
+		case TagRelationship:
+			err = s.encodeRelationship(v.Field(f.Index), f.Tags)
+		case TagLink:
+			err = s.encodeLink(v.Field(f.Index), f.Tags)
+		case TagMeta:
+			err = s.encodeMeta(v.Field(f.Index), f.Tags)
+		}
+		if err != nil {
+			err = s.encodeError(v, typ, f, err)
+			if !e.Context.CollectErrors {
+				return err
+			}
+			errs = errs.appendError(err)
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	primary[resourceKey{s.Resource.Type, s.Resource.ID}] = true
+
+	e.buf.WriteByte('{')
+	if s.Resource.ID != "" {
+		e.buf.WriteString(`"id":`)
+		e.writeValue(s.Resource.ID)
+		e.buf.WriteByte(',')
+	}
+	e.buf.WriteString(`"type":`)
+	e.writeValue(s.Resource.Type)
+	if len(attributes) > 0 {
+		e.buf.WriteString(`,"attributes":{`)
+		for it, f := range attributes {
+			if it > 0 {
+				e.buf.WriteByte(',')
+			}
+			e.writeValue(f.Key)
+			e.buf.WriteByte(':')
+			if err := e.writeValue(v.Field(f.Index).Interface()); err != nil {
+				return err
+			}
+		}
+		e.buf.WriteByte('}')
+	}
+	if len(s.Resource.Relationships) > 0 {
+		e.buf.WriteString(`,"relationships":`)
+		if err := e.writeValue(s.Resource.Relationships); err != nil {
+			return err
+		}
+	}
+	if len(s.Resource.Links) > 0 {
+		e.buf.WriteString(`,"links":`)
+		if err := e.writeValue(s.Resource.Links); err != nil {
+			return err
+		}
+	}
+	if len(s.Resource.Meta) > 0 {
+		e.buf.WriteString(`,"meta":`)
+		if err := e.writeValue(s.Resource.Meta); err != nil {
+			return err
+		}
+	}
+	e.buf.WriteByte('}')
+	return nil
+}
+
+// writeValue writes the JSON encoding of v to the buffer.
+func (e *Encoder) writeValue(v interface{}) error {
+	if err := e.enc.Encode(v); err != nil {
+		return err
+	}
+	// Remove the newline added by json.Encoder.
+	e.buf.Truncate(e.buf.Len() - 1)
+	return nil
+}
+
+// flush writes the buffer to the stream and resets it.
+func (e *Encoder) flush() error {
+	_, err := e.w.Write(e.buf.Bytes())
+	e.buf.Reset()
+	return err
+}
+
+var boolType = reflect.TypeOf(true)
+
+// isIterator returns whether or not t is an iterator function type, that is
+// func(func(T) bool).
+func isIterator(t reflect.Type) bool {
+	if t.Kind() != reflect.Func || t.NumIn() != 1 || t.NumOut() != 0 {
+		return false
+	}
+	yield := t.In(0)
+	return yield.Kind() == reflect.Func && yield.NumIn() == 1 &&
+		yield.NumOut() == 1 && yield.Out(0) == boolType
+}
+
+// iterate calls fn for every value of the iterator function it, stopping at
+// the first error.
+func iterate(it reflect.Value, fn func(reflect.Value) error) error {
+	var err error
+	yield := reflect.MakeFunc(it.Type().In(0),
+		func(args []reflect.Value) []reflect.Value {
+			err = fn(args[0])
+			return []reflect.Value{reflect.ValueOf(err == nil)}
+		})
+	it.Call([]reflect.Value{yield})
+	return err
+}
+
+// Decoder is a struct reading JSON API documents from an input stream and
+// decoding them to tagged structs, tokenizing the input only once.
+type Decoder struct {
+	Context *Context
+
+	dec *json.Decoder
+}
+
+// NewDecoder returns a new Decoder reading from r. This function is
+// equivalent to calling NewDecoder on a blank Context.
+func NewDecoder(r io.Reader) *Decoder {
+	c := new(Context)
+	return c.NewDecoder(r)
+}
+
+// NewDecoder returns a new Decoder reading from r, using c as the Context.
+// The Decoder decodes numbers as json.Number if the Context uses numbers.
+func (c *Context) NewDecoder(r io.Reader) *Decoder {
+	d := &Decoder{
+		Context: c,
+		dec:     json.NewDecoder(r),
+	}
+	if c.UseNumber {
+		d.dec.UseNumber()
+	}
+	return d
+}
+
+// UseNumber causes the Decoder to decode numbers as json.Number instead of
+// float64, as Root.UseNumber does.
+func (d *Decoder) UseNumber() {
+	d.dec.UseNumber()
+}
+
+// Decode reads the next JSON API document from the stream and stores it in
+// the value pointed to by v, as Context.Unmarshal does.
+// The document is read into a Root before being decoded, as the included
+// resources of embedded relationships may come after the primary data, so
+// Decode only saves the intermediate copies of json.Unmarshal and uses as
+// much memory as Unmarshal otherwise. DecodeEach decodes the primary
+// resources as they are read instead.
+func (d *Decoder) Decode(v interface{}) error {
+	root, err := d.readDocument(nil)
+	if err != nil {
+		return err
+	}
+	return d.Context.Unmarshal(root, v)
+}
+
+// DecodeRoot reads the next JSON API document from the stream and returns it
+// as a Root.
+func (d *Decoder) DecodeRoot() (*Root, error) {
+	return d.readDocument(nil)
+}
+
+// DecodeEach reads the next JSON API document from the stream and decodes
+// its primary resources one at a time to the struct pointed to by v, calling
+// fn after each of them. The struct is reset before every resource, and
+// decoding stops at the first error returned by fn.
+// As resources are decoded while they are read, embedded relationships only
+// get their identifier set, even if the related resources are included.
+func (d *Decoder) DecodeEach(v interface{}, fn func() error) error {
+	ptr := reflect.ValueOf(v)
+	if ptr.Kind() != reflect.Ptr || ptr.IsNil() ||
+		ptr.Elem().Kind() != reflect.Struct {
+		return ErrDecodingInvalidType
+	}
+	elem := ptr.Elem()
+	zero := reflect.Zero(elem.Type())
+
+	root, err := d.readDocument(func(resource *Resource, pointer string) error {
+		dec := &decoder{
+			Context: d.Context,
+		}
+		dec.indexResources(&Root{Data: &Resources{Data: []*Resource{resource}}})
+		dec.Resource = resource
+		dec.Pointer = pointer
+		elem.Set(zero)
+		if err := dec.unmarshalResource(elem); err != nil {
+			return err
+		}
+		return fn()
+	})
+	if err != nil {
+		return err
+	}
+	if root.HasErrors() {
+		return root.Errors
+	}
+	if root.Data == nil {
+		return ErrDecodingNoData
+	}
+	return nil
+}
+
+// readDocument reads a top-level document from the stream. If each is not
+// nil, it is called for every primary resource instead of storing them in
+// the returned Root.
+func (d *Decoder) readDocument(
+	each func(resource *Resource, pointer string) error) (*Root, error) {
+	root := NewRoot()
+	if err := d.expectDelim('{'); err != nil {
+		return nil, err
+	}
+	for d.dec.More() {
+		token, err := d.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch token {
+		case "data":
+			err = d.readData(root, each)
+		case "included":
+			err = d.dec.Decode(&root.Included)
+		case "errors":
+			err = d.dec.Decode(&root.Errors)
+		case "meta":
+			err = d.dec.Decode(&root.Meta)
+		case "links":
+			err = d.dec.Decode(&root.Links)
+		case "jsonapi":
+			err = d.dec.Decode(&root.JSONAPI)
+		default:
+			var skipped json.RawMessage
+			err = d.dec.Decode(&skipped)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := d.expectDelim('}'); err != nil {
+		return nil, err
+	}
+	if root.Data != nil && len(root.Errors) > 0 {
+		return nil, ErrRootDataAndErrors
+	}
+	return root, nil
+}
+
+// readData reads the primary data of a document, whether it's a single
+// resource, an array of resources or null.
+func (d *Decoder) readData(root *Root,
+	each func(resource *Resource, pointer string) error) error {
+	token, err := d.dec.Token()
+	if err != nil {
+		return err
+	}
+	switch token {
+	case nil:
+		root.Data = NewResourcesOne()
+		return nil
+	case json.Delim('{'):
+		resource, err := d.readResource()
+		if err != nil {
+			return err
+		}
+		root.Data = NewResourcesOne()
+		if each != nil {
+			return each(resource, "/data")
+		}
+		root.Data.SetResource(resource)
+		return nil
+	case json.Delim('['):
+		root.Data = NewResourcesMany()
+		for it := 0; d.dec.More(); it++ {
+			resource := new(Resource)
+			if err := d.dec.Decode(resource); err != nil {
+				return err
+			}
+			if each != nil {
+				err = each(resource, "/data/"+strconv.Itoa(it))
+				if err != nil {
+					return err
+				}
+				continue
+			}
+			root.Data.AddResource(resource)
+		}
+		return d.expectDelim(']')
+	}
+	return ErrResourcesBadType
+}
+
+// readResource reads the members of a resource object whose opening brace
+// was already read.
+func (d *Decoder) readResource() (*Resource, error) {
+	resource := new(Resource)
+	for d.dec.More() {
+		token, err := d.dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		switch token {
+		case "id":
+			err = d.dec.Decode(&resource.ID)
+		case "type":
+			err = d.dec.Decode(&resource.Type)
+		case "attributes":
+			err = d.dec.Decode(&resource.Attributes)
+		case "relationships":
+			err = d.dec.Decode(&resource.Relationships)
+		case "links":
+			err = d.dec.Decode(&resource.Links)
+		case "meta":
+			err = d.dec.Decode(&resource.Meta)
+		default:
+			var skipped json.RawMessage
+			err = d.dec.Decode(&skipped)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resource, d.expectDelim('}')
+}
+
+// expectDelim reads the next token of the stream, and returns an error if it
+// isn't the given delimiter.
+func (d *Decoder) expectDelim(delim json.Delim) error {
+	token, err := d.dec.Token()
+	if err != nil {
+		return err
+	}
+	if token != delim {
+		return fmt.Errorf("%w: expected %v, got %v", ErrDecodingMalformed,
+			delim, token)
+	}
+	return nil
+}
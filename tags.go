@@ -20,6 +20,11 @@ const (
 	// meta object.
 	TagMeta = "meta"
 
+	// TagData is the top-level tag used to mark the member of a document
+	// struct holding the primary data. The meta members of such a struct are
+	// part of the top-level meta object.
+	TagData = "data"
+
 	// TagValue is the tag used when populating structs of a context. Member
 	// marked with this tag can and will be set to a specific value when
 	// using contexted members.
@@ -37,6 +42,11 @@ const (
 	// linkage relationship.
 	TagRelationshipData = "data"
 
+	// TagRelationshipEmbed is the sub-tag used to define a value as a
+	// relationship whose related resources are embedded in the struct, and
+	// are side-loaded in the included member of the document.
+	TagRelationshipEmbed = "embed"
+
 	// TagLinkContext is the sub-tag used to define a value as a context link.
 	TagLinkContext = "context"
 )
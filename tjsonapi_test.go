@@ -1,9 +1,21 @@
 package tjsonapi
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 )
 
 type TestStruct struct {
@@ -97,3 +109,1753 @@ func TestDecode(t *testing.T) {
 		t.Error("Re-encoded root does not match encoded root")
 	}
 }
+
+func TestDecodeRelationshipData(t *testing.T) {
+	var root Root
+	json.Unmarshal([]byte(`{"data":{"id":"1","type":"test","relationships":{`+
+		`"one":{"data":null},"many":{"data":[{"id":"3","type":"other"}]}}}}`),
+		&root)
+	s := basicTestStruct
+	s.OneRelationship, s.ManyRelationships = 2, []int{1, 2}
+	if err := Unmarshal(&root, &s); err != nil {
+		t.Fatal("Error while unmarshaling relationships:", err)
+	}
+	if s.OneRelationship != 0 || !reflect.DeepEqual(s.ManyRelationships,
+		[]int{3}) {
+		t.Error("Linkages should replace the relationships:",
+			s.OneRelationship, s.ManyRelationships)
+	}
+}
+
+func TestDecodeNullData(t *testing.T) {
+	var root Root
+	if err := json.Unmarshal([]byte(`{"data":null}`), &root); err != nil {
+		t.Fatal("Error while unmarshaling null document:", err)
+	}
+	s := basicTestStruct
+	if err := Unmarshal(&root, &s); err != nil {
+		t.Error("Error while unmarshaling null data:", err)
+	}
+	if !reflect.DeepEqual(s, TestStruct{}) {
+		t.Error("Null data should set the zero value:", s)
+	}
+
+	root = Root{}
+	if err := json.Unmarshal([]byte(`{"meta":{}}`), &root); err != nil {
+		t.Fatal("Error while unmarshaling document:", err)
+	}
+	if err := Unmarshal(&root, &s); !errors.Is(err, ErrDecodingNoData) {
+		t.Error("Missing data should fail:", err)
+	}
+
+	s = basicTestStruct
+	err := NewDecoder(strings.NewReader(`{"data":null}`)).Decode(&s)
+	if err != nil || !reflect.DeepEqual(s, TestStruct{}) {
+		t.Error("Streamed null data should set the zero value:", err, s)
+	}
+}
+
+func TestErrorDocument(t *testing.T) {
+	var root Root
+	err := json.Unmarshal([]byte(`{"errors":[{"status":"404",`+
+		`"title":"Not Found","source":{"parameter":"id"}}]}`), &root)
+	if err != nil {
+		t.Fatal("Error while unmarshaling error document:", err)
+	}
+
+	var s TestStruct
+	err = Unmarshal(&root, &s)
+	var jsonapiErr *Error
+	if !errors.As(err, &jsonapiErr) || jsonapiErr.Status != "404" ||
+		jsonapiErr.Source.Parameter != "id" {
+		t.Error("Unmarshal did not return the document errors:", err)
+	}
+
+	root.Data = NewResourcesOne()
+	root.Data.SetResource(NewResource())
+	if _, err := json.Marshal(&root); !errors.Is(err, ErrRootDataAndErrors) {
+		t.Error("Marshaling data and errors together should fail")
+	}
+	err = json.Unmarshal([]byte(`{"data":{"id":"1","type":"test"},`+
+		`"errors":[{"status":"500"}]}`), new(Root))
+	if !errors.Is(err, ErrRootDataAndErrors) {
+		t.Error("Unmarshaling data and errors together should fail")
+	}
+}
+
+type TestPerson struct {
+	ID   int    `jsonapi:"identifier,people"`
+	Name string `jsonapi:"attribute,name"`
+}
+
+type TestArticle struct {
+	ID       int           `jsonapi:"identifier,articles"`
+	Title    string        `jsonapi:"attribute,title"`
+	Author   *TestPerson   `jsonapi:"relationship,author,embed,people"`
+	Comments []TestComment `jsonapi:"relationship,comments,embed,comments"`
+}
+
+type TestComment struct {
+	ID     int         `jsonapi:"identifier,comments"`
+	Body   string      `jsonapi:"attribute,body"`
+	Author *TestPerson `jsonapi:"relationship,author,embed,people"`
+}
+
+func TestEncodeIncluded(t *testing.T) {
+	author := &TestPerson{ID: 9, Name: "Dan"}
+	articles := []TestArticle{
+		{ID: 1, Title: "First", Author: author, Comments: []TestComment{
+			{ID: 5, Body: "Great", Author: &TestPerson{ID: 2, Name: "Ann"}},
+			{ID: 12, Body: "Thanks", Author: author},
+		}},
+		{ID: 2, Title: "Second", Author: author},
+	}
+
+	root, err := Marshal(articles)
+	if err != nil {
+		t.Fatal("Error while marshaling root:", err)
+	}
+	if len(root.Included) != 4 {
+		t.Fatal("Expected 4 included resources, got", len(root.Included))
+	}
+	linkage, _ := root.Data.Data[0].Relationships["author"].Data.
+		GetResourceIdentifier()
+	if linkage.ID != "9" || linkage.Type != "people" {
+		t.Error("Invalid author linkage:", linkage)
+	}
+	comments, _ := root.Data.Data[0].Relationships["comments"].Data.
+		GetResourceIdentifiers()
+	if len(comments) != 2 || comments[1].ID != "12" {
+		t.Error("Invalid comments linkage:", comments)
+	}
+
+	root, err = Marshal(TestArticle{ID: 3})
+	if err != nil {
+		t.Fatal("Error while marshaling root:", err)
+	}
+	data, _ := json.Marshal(root.Data.Data[0].Relationships["author"])
+	if string(data) != `{"data":null}` {
+		t.Error("Nil embedded resource should have null linkage:", string(data))
+	}
+}
+
+type TestNode struct {
+	ID       int        `jsonapi:"identifier,nodes"`
+	Parent   *TestNode  `jsonapi:"relationship,parent,embed,nodes"`
+	Children []TestNode `jsonapi:"relationship,children,embed,nodes"`
+}
+
+func TestDecodeIncluded(t *testing.T) {
+	author := &TestPerson{ID: 9, Name: "Dan"}
+	articles := []TestArticle{
+		{ID: 1, Title: "First", Author: author, Comments: []TestComment{
+			{ID: 5, Body: "Great", Author: &TestPerson{ID: 2, Name: "Ann"}},
+			{ID: 12, Body: "Thanks", Author: author},
+		}},
+		{ID: 2, Title: "Second", Author: author, Comments: []TestComment{}},
+	}
+	root, _ := Marshal(articles)
+	data, _ := json.Marshal(root)
+	var decodedRoot Root
+	if err := json.Unmarshal(data, &decodedRoot); err != nil {
+		t.Fatal("Error while unmarshaling JSON:", err)
+	}
+
+	var decoded []TestArticle
+	if err := Unmarshal(&decodedRoot, &decoded); err != nil {
+		t.Fatal("Error while unmarshaling root:", err)
+	}
+	if !reflect.DeepEqual(articles, decoded) {
+		t.Errorf("Decoded articles do not match: %+v", decoded)
+	}
+	if decoded[0].Author != decoded[1].Author ||
+		decoded[0].Author != decoded[0].Comments[1].Author {
+		t.Error("Shared references should decode to the same pointer")
+	}
+
+	// Nodes reference each other both by pointer and by value.
+	parent := &TestNode{ID: 1}
+	parent.Children = []TestNode{{ID: 2, Parent: parent}}
+	root, _ = Marshal(parent)
+	data, _ = json.Marshal(root)
+	decodedRoot = Root{}
+	json.Unmarshal(data, &decodedRoot)
+
+	var node TestNode
+	if err := Unmarshal(&decodedRoot, &node); err != nil {
+		t.Fatal("Error while unmarshaling cyclic root:", err)
+	}
+	if len(node.Children) != 1 || node.Children[0].Parent != &node {
+		t.Error("Cyclic reference should resolve to the primary resource")
+	}
+
+	article := TestArticle{ID: 1, Author: author}
+	decodedRoot = Root{}
+	json.Unmarshal([]byte(`{"data":{"type":"articles","id":"1",`+
+		`"relationships":{"comments":{"links":{"self":"/c"}},`+
+		`"author":{"data":null}}}}`), &decodedRoot)
+	if err := Unmarshal(&decodedRoot, &article); err != nil {
+		t.Fatal("Error while unmarshaling null relationship:", err)
+	}
+	if article.Author != nil {
+		t.Error("Null linkage should clear the relationship:", article.Author)
+	}
+	decodedRoot.Data.Data[0].Relationships["author"].Data = nil
+	article.Author = author
+	Unmarshal(&decodedRoot, &article)
+	if article.Author != author {
+		t.Error("Missing linkage should keep the relationship")
+	}
+}
+
+type TestDocument struct {
+	Articles []TestArticle `jsonapi:"data"`
+	Total    int           `jsonapi:"meta,total"`
+}
+
+func TestDocumentMembers(t *testing.T) {
+	c := NewContext()
+	c.JSONAPI = NewJSONAPI()
+	c.DocumentLinks.AddLink(LinkSelf, "/articles")
+	c.DocumentMeta.AddMeta("copyright", "empara")
+
+	document := TestDocument{
+		Articles: []TestArticle{{ID: 1, Title: "First"}},
+		Total:    12,
+	}
+	root, err := c.Marshal(&document)
+	if err != nil {
+		t.Fatal("Error while marshaling document:", err)
+	}
+	if root.JSONAPI.Version != Version {
+		t.Error("Invalid jsonapi object:", root.JSONAPI)
+	}
+	if self, _ := root.Links.GetLink(LinkSelf); self != "/articles" {
+		t.Error("Invalid self link:", self)
+	}
+	if root.Meta["total"] != 12 || root.Meta["copyright"] != "empara" {
+		t.Error("Invalid top-level meta:", root.Meta)
+	}
+	if len(root.Data.Data) != 1 || root.Data.Type != ResourcesMany {
+		t.Error("Document data should be used as primary data")
+	}
+
+	data, _ := json.Marshal(root)
+	var decodedRoot Root
+	json.Unmarshal(data, &decodedRoot)
+	var decoded TestDocument
+	if err := Unmarshal(&decodedRoot, &decoded); err != nil {
+		t.Fatal("Error while unmarshaling document:", err)
+	}
+	if decoded.Total != 12 || len(decoded.Articles) != 1 ||
+		decoded.Articles[0].Title != "First" {
+		t.Errorf("Decoded document does not match: %+v", decoded)
+	}
+}
+
+type TestLinked struct {
+	ID       int    `jsonapi:"identifier,linked"`
+	Self     string `jsonapi:"link,self"`
+	Related  *Link  `jsonapi:"link,related"`
+	Download string `jsonapi:"link,download,context"`
+	Revision int    `jsonapi:"meta,revision"`
+}
+
+func TestEncodeLinksAndMeta(t *testing.T) {
+	c := NewContext()
+	c.Links["download"] = &Link{Meta: map[string]interface{}{"size": 42}}
+
+	linked := TestLinked{
+		ID:       1,
+		Self:     "/linked/1",
+		Related:  &Link{HRef: "/linked/1/related"},
+		Download: "/files/1",
+		Revision: 3,
+	}
+	root, err := c.Marshal(linked)
+	if err != nil {
+		t.Fatal("Error while marshaling root:", err)
+	}
+	resource := root.Data.Data[0]
+	if self, _ := resource.Links.GetLink(LinkSelf); self != "/linked/1" {
+		t.Error("Invalid self link:", self)
+	}
+	if related, _ := resource.Links.GetLink(LinkRelated); related !=
+		"/linked/1/related" {
+		t.Error("Invalid related link:", related)
+	}
+	download, _ := resource.Links.GetLink("download")
+	meta, _ := resource.Links.GetLinkMeta("download")
+	if download != "/files/1" || meta["size"] != 42 {
+		t.Error("Invalid context link:", download, meta)
+	}
+	if c.Links["download"].HRef != "" {
+		t.Error("Context link template should not be modified")
+	}
+	if resource.Meta["revision"] != 3 {
+		t.Error("Invalid resource meta:", resource.Meta)
+	}
+}
+
+type TestRoundTrip struct {
+	ID       int           `jsonapi:"identifier,roundtrips"`
+	Self     string        `jsonapi:"link,self"`
+	Related  *Link         `jsonapi:"link,related"`
+	Revision int           `jsonapi:"meta,revision"`
+	Owner    Relationship  `jsonapi:"relationship,owner"`
+	Editor   *Relationship `jsonapi:"relationship,editor"`
+	Comments string        `jsonapi:"relationship,comments,link"`
+}
+
+func TestDecodeLinksAndMeta(t *testing.T) {
+	owner := NewRelationship()
+	owner.Links.AddLink(LinkRelated, "/people/1")
+	editor := NewRelationship()
+	editor.Meta.AddMeta("since", "2016")
+	related := NewLink()
+	related.HRef = "/roundtrips/1/related"
+	related.Meta["count"] = 2
+	roundTrip := TestRoundTrip{
+		ID:       1,
+		Self:     "/roundtrips/1",
+		Related:  related,
+		Revision: 3,
+		Owner:    *owner,
+		Editor:   editor,
+		Comments: "/roundtrips/1/comments",
+	}
+
+	root, err := Marshal(roundTrip)
+	if err != nil {
+		t.Fatal("Error while marshaling root:", err)
+	}
+	var decoded TestRoundTrip
+	if err := Unmarshal(root, &decoded); err != nil {
+		t.Fatal("Error while unmarshaling root:", err)
+	}
+	if !reflect.DeepEqual(roundTrip, decoded) {
+		t.Errorf("Decoded struct does not match: %+v", decoded)
+	}
+
+	data, _ := json.Marshal(root)
+	var decodedRoot Root
+	json.Unmarshal(data, &decodedRoot)
+	decoded = TestRoundTrip{}
+	if err := Unmarshal(&decodedRoot, &decoded); err != nil {
+		t.Fatal("Error while unmarshaling JSON root:", err)
+	}
+	if decoded.Self != roundTrip.Self || decoded.Revision != 3 ||
+		decoded.Related.HRef != related.HRef ||
+		decoded.Related.Meta["count"] != 2.0 ||
+		decoded.Comments != roundTrip.Comments ||
+		decoded.Editor.Meta["since"] != "2016" {
+		t.Errorf("Decoded JSON does not match: %+v", decoded)
+	}
+}
+
+type TestAddress struct {
+	Street string `json:"street"`
+	City   string `json:"city,omitempty"`
+}
+
+type TestProfile struct {
+	ID       int                    `jsonapi:"identifier,profiles"`
+	Address  TestAddress            `jsonapi:"attribute,address"`
+	Previous *TestAddress           `jsonapi:"attribute,previous"`
+	Tags     []string               `jsonapi:"attribute,tags"`
+	Scores   [2]int                 `jsonapi:"attribute,scores"`
+	Settings map[string]bool        `jsonapi:"attribute,settings"`
+	Extra    interface{}            `jsonapi:"attribute,extra"`
+	Raw      map[string]interface{} `jsonapi:"attribute,raw"`
+}
+
+func TestDecodeComplexAttributes(t *testing.T) {
+	profile := TestProfile{
+		ID:       1,
+		Address:  TestAddress{Street: "Main street", City: "Paris"},
+		Previous: &TestAddress{Street: "Old street"},
+		Tags:     []string{"a", "b"},
+		Scores:   [2]int{4, 2},
+		Settings: map[string]bool{"public": true},
+		Extra:    []interface{}{"x", 1.0},
+		Raw:      map[string]interface{}{"nested": map[string]interface{}{}},
+	}
+	root, _ := Marshal(profile)
+	data, _ := json.Marshal(root)
+	var decodedRoot Root
+	json.Unmarshal(data, &decodedRoot)
+
+	var decoded TestProfile
+	if err := Unmarshal(&decodedRoot, &decoded); err != nil {
+		t.Fatal("Error while unmarshaling root:", err)
+	}
+	if !reflect.DeepEqual(profile, decoded) {
+		t.Errorf("Decoded struct does not match: %+v", decoded)
+	}
+
+	decodedRoot.Data.Data[0].Attributes["tags"] = map[string]interface{}{}
+	err := Unmarshal(&decodedRoot, &decoded)
+	if !errors.Is(err, ErrDecodingInvalidType) {
+		t.Error("Decoding an object to a slice should fail:", err)
+	}
+}
+
+type TestNumbers struct {
+	ID      int     `jsonapi:"identifier,numbers"`
+	Big     int64   `jsonapi:"attribute,big"`
+	Small   int8    `jsonapi:"attribute,small"`
+	Literal string  `jsonapi:"attribute,literal"`
+	Flag    bool    `jsonapi:"attribute,flag"`
+	Ratio   float32 `jsonapi:"attribute,ratio"`
+}
+
+func TestDecodeNumbers(t *testing.T) {
+	data := []byte(`{"data":{"id":"1","type":"numbers","attributes":{` +
+		`"big":9007199254740993,"small":-12,"literal":12345678901234567890,` +
+		`"flag":0,"ratio":0.5}}}`)
+	root := NewRoot()
+	root.UseNumber()
+	if err := json.Unmarshal(data, root); err != nil {
+		t.Fatal("Error while unmarshaling JSON:", err)
+	}
+
+	var numbers TestNumbers
+	if err := Unmarshal(root, &numbers); err != nil {
+		t.Fatal("Error while unmarshaling root:", err)
+	}
+	expected := TestNumbers{1, 9007199254740993, -12, "12345678901234567890",
+		false, 0.5}
+	if numbers != expected {
+		t.Errorf("Decoded numbers do not match: %+v", numbers)
+	}
+
+	root.Data.Data[0].Attributes["small"] = json.Number("300")
+	err := Unmarshal(root, &numbers)
+	if !errors.Is(err, ErrDecodingOverflow) {
+		t.Error("Decoding 300 to an int8 should overflow:", err)
+	}
+	root.Data.Data[0].Attributes["small"] = 300.0
+	err = Unmarshal(root, &numbers)
+	if !errors.Is(err, ErrDecodingOverflow) {
+		t.Error("Decoding 300.0 to an int8 should overflow:", err)
+	}
+}
+
+func TestDecodeStrict(t *testing.T) {
+	decode := func(c *Context, data string) error {
+		var root Root
+		if err := json.Unmarshal([]byte(data), &root); err != nil {
+			t.Fatal("Error while unmarshaling JSON:", err)
+		}
+		var s TestStruct
+		return c.Unmarshal(&root, &s)
+	}
+	strict := NewContext()
+	strict.Strict = true
+
+	invalidID := `{"data":{"id":"abc","type":"test"}}`
+	if err := decode(NewContext(), invalidID); err != nil {
+		t.Error("Lenient context should ignore parsing errors:", err)
+	}
+	err := decode(strict, invalidID)
+	if !errors.Is(err, ErrDecodingInvalidValue) ||
+		!strings.Contains(err.Error(), "id") {
+		t.Error("Strict context should report parsing errors:", err)
+	}
+
+	err = decode(strict, `{"data":{"id":"1","type":"test",`+
+		`"attributes":{"first":1,"unknown":true}}}`)
+	if !errors.Is(err, ErrDecodingUnknownMember) ||
+		!strings.Contains(err.Error(), "attributes/unknown") {
+		t.Error("Strict context should report unknown attributes:", err)
+	}
+	err = decode(strict, `{"data":{"id":"1","type":"test",`+
+		`"relationships":{"other":{"data":null}}}}`)
+	if !errors.Is(err, ErrDecodingUnknownMember) ||
+		!strings.Contains(err.Error(), "relationships/other") {
+		t.Error("Strict context should report unknown relationships:", err)
+	}
+
+	mismatch := `{"data":{"id":"1","type":"test","attributes":{"second":12}}}`
+	if err := decode(NewContext(), mismatch); err != nil {
+		t.Error("Lenient context should convert numbers to strings:", err)
+	}
+	err = decode(strict, mismatch)
+	if !errors.Is(err, ErrDecodingInvalidType) ||
+		!strings.Contains(err.Error(), "attributes/second") {
+		t.Error("Strict context should report type mismatches:", err)
+	}
+}
+
+type TestPriced struct {
+	ID    int `jsonapi:"identifier,priced"`
+	Price int `jsonapi:"attribute,price"`
+}
+
+func TestDecodeError(t *testing.T) {
+	var root Root
+	json.Unmarshal([]byte(`{"data":[{"id":"1","type":"priced",`+
+		`"attributes":{"price":12}},{"id":"2","type":"priced",`+
+		`"attributes":{"price":"free"}}]}`), &root)
+	c := NewContext()
+	c.Strict = true
+
+	var priced []TestPriced
+	err := c.Unmarshal(&root, &priced)
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) {
+		t.Fatal("Expected a DecodeError, got", err)
+	}
+	if decodeErr.Pointer != "/data/1/attributes/price" ||
+		decodeErr.Field != "TestPriced.Price" ||
+		decodeErr.Expected != "int" || decodeErr.Actual != "string" {
+		t.Errorf("Invalid decode error: %+v", decodeErr)
+	}
+	if !errors.Is(err, ErrDecodingInvalidType) {
+		t.Error("Decode error should wrap the sentinel error:", err)
+	}
+
+	jsonapiErr := decodeErr.JSONAPIError()
+	if jsonapiErr.Status != "422" ||
+		jsonapiErr.Source.Pointer != "/data/1/attributes/price" {
+		t.Errorf("Invalid error object: %+v", jsonapiErr)
+	}
+
+	root.Data.Data[1].Type = "other"
+	err = c.Unmarshal(&root, &priced)
+	if !errors.As(err, &decodeErr) || decodeErr.Pointer != "/data/1/type" ||
+		decodeErr.JSONAPIError().Status != "409" {
+		t.Error("Mismatching types should be a conflict:", err)
+	}
+
+	var invalid struct {
+		ID     int       `jsonapi:"identifier,priced"`
+		Parent *TestNode `jsonapi:"relationship,parent,embed"`
+	}
+	json.Unmarshal([]byte(`{"data":{"id":"1","type":"priced",`+
+		`"relationships":{"parent":{"data":null}}}}`), &root)
+	err = c.Unmarshal(&root, &invalid)
+	if !errors.As(err, &decodeErr) || !errors.Is(err, ErrDecodingInvalidTag) {
+		t.Fatal("Expected an invalid tag error, got", err)
+	}
+	jsonapiErr = decodeErr.JSONAPIError()
+	if jsonapiErr.Status != "500" || jsonapiErr.Source != nil {
+		t.Errorf("Invalid tags should be server errors: %+v", jsonapiErr)
+	}
+}
+
+func TestCollectErrors(t *testing.T) {
+	var root Root
+	json.Unmarshal([]byte(`{"data":[{"id":"1","type":"priced",`+
+		`"attributes":{"price":"free","discount":10}},{"id":"x",`+
+		`"type":"priced","attributes":{"price":12}},{"id":"3",`+
+		`"type":"priced","attributes":{"price":true}}]}`), &root)
+	c := NewContext()
+	c.Strict = true
+	c.CollectErrors = true
+
+	var priced []TestPriced
+	err := c.Unmarshal(&root, &priced)
+	var errs ErrorList
+	if !errors.As(err, &errs) || len(errs) != 4 {
+		t.Fatal("Expected 4 collected errors, got", err)
+	}
+	if !errors.Is(err, ErrDecodingUnknownMember) ||
+		!errors.Is(err, ErrDecodingInvalidValue) {
+		t.Error("Collected errors should be unwrappable:", err)
+	}
+
+	objects := errs.JSONAPIErrors()
+	pointers := []string{"/data/0/attributes/price",
+		"/data/0/attributes/discount", "/data/1/id", "/data/2/attributes/price"}
+	for it, pointer := range pointers {
+		if objects[it].Source.Pointer != pointer || objects[it].Status != "422" {
+			t.Errorf("Invalid error object %d: %+v", it, objects[it])
+		}
+	}
+
+	c.CollectErrors = false
+	if err := c.Unmarshal(&root, &priced); errors.As(err, &errs) {
+		t.Error("Errors should not be collected by default:", err)
+	}
+}
+
+type TestInvalidTags struct {
+	ID    int    `jsonapi:"identifier,invalid"`
+	Name  string `jsonapi:"attribute"`
+	Owner string `jsonapi:"relationship"`
+}
+
+func TestCollectEncodingErrors(t *testing.T) {
+	c := NewContext()
+	c.CollectErrors = true
+	_, err := c.Marshal([]TestInvalidTags{{ID: 1}, {ID: 2}})
+	var errs ErrorList
+	if !errors.As(err, &errs) || len(errs) != 4 ||
+		!errors.Is(err, ErrEncodingInvalidTag) {
+		t.Error("Expected 4 collected encoding errors, got", err)
+	}
+	var encodeErr *EncodeError
+	if !errors.As(errs[3], &encodeErr) || encodeErr.Index != 1 ||
+		encodeErr.Type != "invalid" || encodeErr.ID != "2" ||
+		encodeErr.Field != "TestInvalidTags.Owner" {
+		t.Errorf("Collected errors should locate the member: %v", errs[3])
+	}
+}
+
+func benchmarkRoot() (*Root, []TestArticle) {
+	articles := make([]TestArticle, 1000)
+	for it := range articles {
+		articles[it] = TestArticle{
+			ID:     it,
+			Title:  "Title",
+			Author: &TestPerson{ID: it % 10, Name: "Name"},
+		}
+	}
+	root, _ := Marshal(articles)
+	return root, articles
+}
+
+func BenchmarkMarshal(b *testing.B) {
+	_, articles := benchmarkRoot()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for it := 0; it < b.N; it++ {
+		Marshal(articles)
+	}
+}
+
+// clearPlans empties the cache of plans, so that the next use of every type
+// compiles its plan again.
+func clearPlans() {
+	typePlans.Range(func(key, _ interface{}) bool {
+		typePlans.Delete(key)
+		return true
+	})
+}
+
+// BenchmarkMarshalResource and BenchmarkMarshalResourceUncached measure the
+// benefits of caching plans, which are compiled once per call without cache.
+func BenchmarkMarshalResource(b *testing.B) {
+	_, articles := benchmarkRoot()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for it := 0; it < b.N; it++ {
+		Marshal(articles[it%len(articles)])
+	}
+}
+
+func BenchmarkMarshalResourceUncached(b *testing.B) {
+	_, articles := benchmarkRoot()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for it := 0; it < b.N; it++ {
+		clearPlans()
+		Marshal(articles[it%len(articles)])
+	}
+}
+
+func BenchmarkUnmarshal(b *testing.B) {
+	root, _ := benchmarkRoot()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for it := 0; it < b.N; it++ {
+		var articles []TestArticle
+		Unmarshal(root, &articles)
+	}
+}
+
+func BenchmarkUnmarshalResource(b *testing.B) {
+	root, _ := Marshal(TestArticle{ID: 1, Title: "Title",
+		Author: &TestPerson{ID: 1, Name: "Name"}})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for it := 0; it < b.N; it++ {
+		var article TestArticle
+		Unmarshal(root, &article)
+	}
+}
+
+func BenchmarkUnmarshalResourceUncached(b *testing.B) {
+	root, _ := Marshal(TestArticle{ID: 1, Title: "Title",
+		Author: &TestPerson{ID: 1, Name: "Name"}})
+	b.ReportAllocs()
+	b.ResetTimer()
+	for it := 0; it < b.N; it++ {
+		clearPlans()
+		var article TestArticle
+		Unmarshal(root, &article)
+	}
+}
+
+func BenchmarkCompilePlan(b *testing.B) {
+	t := reflect.TypeOf(TestArticle{})
+	b.ReportAllocs()
+	for it := 0; it < b.N; it++ {
+		compilePlan(t)
+	}
+}
+
+func jsonEqual(t *testing.T, first, second []byte) bool {
+	var firstValue, secondValue interface{}
+	if err := json.Unmarshal(first, &firstValue); err != nil {
+		t.Fatal("Invalid JSON:", err, string(first))
+	}
+	if err := json.Unmarshal(second, &secondValue); err != nil {
+		t.Fatal("Invalid JSON:", err, string(second))
+	}
+	return reflect.DeepEqual(firstValue, secondValue)
+}
+
+func TestStreamEncoder(t *testing.T) {
+	author := &TestPerson{ID: 9, Name: "Dan"}
+	articles := []TestArticle{
+		{ID: 1, Title: "First", Author: author, Comments: []TestComment{
+			{ID: 5, Body: "Great", Author: &TestPerson{ID: 2, Name: "Ann"}},
+		}},
+		{ID: 2, Title: "Second", Author: author},
+	}
+	c := NewContext()
+	c.JSONAPI = NewJSONAPI()
+	c.DocumentMeta.AddMeta("count", 2)
+
+	root, _ := c.Marshal(articles)
+	expected, _ := json.Marshal(root)
+
+	var buf bytes.Buffer
+	if err := c.NewEncoder(&buf).Encode(articles); err != nil {
+		t.Fatal("Error while encoding slice:", err)
+	}
+	if !jsonEqual(t, expected, buf.Bytes()) {
+		t.Errorf("Encoded slice does not match:\n%s\n%s", expected, buf.Bytes())
+	}
+
+	ch := make(chan TestArticle)
+	go func() {
+		for _, article := range articles {
+			ch <- article
+		}
+		close(ch)
+	}()
+	buf.Reset()
+	if err := c.NewEncoder(&buf).Encode(ch); err != nil {
+		t.Fatal("Error while encoding channel:", err)
+	}
+	if !jsonEqual(t, expected, buf.Bytes()) {
+		t.Errorf("Encoded channel does not match:\n%s", buf.Bytes())
+	}
+
+	iterator := func(yield func(*TestArticle) bool) {
+		for it := range articles {
+			if !yield(&articles[it]) {
+				return
+			}
+		}
+	}
+	buf.Reset()
+	if err := c.NewEncoder(&buf).Encode(iterator); err != nil {
+		t.Fatal("Error while encoding iterator:", err)
+	}
+	if !jsonEqual(t, expected, buf.Bytes()) {
+		t.Errorf("Encoded iterator does not match:\n%s", buf.Bytes())
+	}
+
+	buf.Reset()
+	if err := NewEncoder(&buf).Encode(basicTestStruct); err != nil {
+		t.Fatal("Error while encoding struct:", err)
+	}
+	root, _ = Marshal(basicTestStruct)
+	expected, _ = json.Marshal(root)
+	if !jsonEqual(t, expected, buf.Bytes()) {
+		t.Errorf("Encoded struct does not match:\n%s", buf.Bytes())
+	}
+
+	invalid := []struct {
+		value    interface{}
+		expected error
+	}{
+		{struct {
+			ID    int    `jsonapi:"identifier,test"`
+			Links string `jsonapi:"attribute,links"`
+		}{}, ErrAttributeInvalidKey},
+		{struct {
+			ID      int      `jsonapi:"identifier,test"`
+			Channel chan int `jsonapi:"attribute,channel"`
+		}{}, ErrInvalidJSONValue},
+	}
+	for _, test := range invalid {
+		_, marshalErr := Marshal(test.value)
+		encodeErr := NewEncoder(io.Discard).Encode(test.value)
+		if !errors.Is(marshalErr, test.expected) ||
+			!errors.Is(encodeErr, test.expected) {
+			t.Errorf("Encoders should both fail with %v: %v, %v",
+				test.expected, marshalErr, encodeErr)
+		}
+	}
+}
+
+func TestStreamEncoderErrors(t *testing.T) {
+	u, _ := url.Parse("/people")
+	c := NewContext()
+	c.Pagination = NewPagination(u, Page{Size: 2})
+	var buf bytes.Buffer
+	people := []TestPerson{{ID: 1}, {ID: 1}}
+	if err := c.NewEncoder(&buf).Encode(people); err != nil {
+		t.Fatal("Error while encoding duplicate resources:", err)
+	}
+	if !strings.Contains(buf.String(), `"next"`) {
+		t.Errorf("Pagination should count every resource:\n%s", buf.Bytes())
+	}
+
+	c = NewContext()
+	c.CollectErrors = true
+	buf.Reset()
+	mixed := []interface{}{TestPerson{ID: 1}, TestInvalidTags{ID: 2},
+		TestPerson{ID: 3}}
+	err := c.NewEncoder(&buf).Encode(mixed)
+	var errs ErrorList
+	var encodeErr *EncodeError
+	if !errors.As(err, &errs) || len(errs) != 2 ||
+		!errors.As(errs[0], &encodeErr) || encodeErr.Index != 1 {
+		t.Error("Expected 2 collected encoding errors, got", err)
+	}
+	var root Root
+	if err := json.Unmarshal(buf.Bytes(), &root); err != nil ||
+		len(root.Data.Data) != 2 || root.Data.Data[1].ID != "3" {
+		t.Errorf("Failing resources should be left out:\n%s", buf.Bytes())
+	}
+
+	ch := make(chan TestInvalidTags)
+	done := make(chan struct{})
+	go func() {
+		for it := 0; it < 3; it++ {
+			ch <- TestInvalidTags{ID: it}
+		}
+		close(ch)
+		close(done)
+	}()
+	if err := NewEncoder(io.Discard).Encode(ch); err == nil {
+		t.Error("Encoding invalid resources should fail")
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("Channel should be drained after an error")
+	}
+}
+
+func BenchmarkStreamEncoder(b *testing.B) {
+	_, articles := benchmarkRoot()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for it := 0; it < b.N; it++ {
+		NewEncoder(io.Discard).Encode(articles)
+	}
+}
+
+func BenchmarkMarshalJSON(b *testing.B) {
+	_, articles := benchmarkRoot()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for it := 0; it < b.N; it++ {
+		root, _ := Marshal(articles)
+		json.NewEncoder(io.Discard).Encode(root)
+	}
+}
+
+func TestStreamDecoder(t *testing.T) {
+	author := &TestPerson{ID: 9, Name: "Dan"}
+	articles := []TestArticle{
+		{ID: 1, Title: "First", Author: author},
+		{ID: 2, Title: "Second", Author: author},
+	}
+	var buf bytes.Buffer
+	if err := NewEncoder(&buf).Encode(articles); err != nil {
+		t.Fatal("Error while encoding slice:", err)
+	}
+	data := buf.Bytes()
+
+	var decoded []TestArticle
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&decoded); err != nil {
+		t.Fatal("Error while decoding slice:", err)
+	}
+	var expected []TestArticle
+	root := new(Root)
+	json.Unmarshal(data, root)
+	Unmarshal(root, &expected)
+	if !reflect.DeepEqual(expected, decoded) {
+		t.Errorf("Decoded slice does not match: %+v", decoded)
+	}
+
+	var article TestArticle
+	var titles []string
+	err := NewDecoder(bytes.NewReader(data)).DecodeEach(&article,
+		func() error {
+			if article.Author == nil || article.Author.ID != 9 {
+				t.Errorf("Author identifier not decoded: %+v", article)
+			}
+			titles = append(titles, article.Title)
+			return nil
+		})
+	if err != nil {
+		t.Fatal("Error while decoding each resource:", err)
+	}
+	if !reflect.DeepEqual(titles, []string{"First", "Second"}) {
+		t.Errorf("Unexpected decoded titles: %v", titles)
+	}
+
+	stop := errors.New("stop")
+	count := 0
+	err = NewDecoder(bytes.NewReader(data)).DecodeEach(&article,
+		func() error {
+			count++
+			return stop
+		})
+	if !errors.Is(err, stop) || count != 1 {
+		t.Errorf("Callback error not returned: %v (%d calls)", err, count)
+	}
+
+	var person TestPerson
+	err = NewDecoder(strings.NewReader(
+		`{"data":{"type":"people","id":"3","attributes":{"name":"Eve"}}}`,
+	)).Decode(&person)
+	if err != nil || person.ID != 3 || person.Name != "Eve" {
+		t.Errorf("Single resource not decoded: %+v, %v", person, err)
+	}
+
+	err = NewDecoder(strings.NewReader(
+		`{"errors":[{"status":"404","title":"Not Found"}]}`,
+	)).Decode(&person)
+	var errs Errors
+	if !errors.As(err, &errs) || errs[0].Status != "404" {
+		t.Errorf("Error document not returned: %v", err)
+	}
+}
+
+func BenchmarkStreamDecoder(b *testing.B) {
+	_, articles := benchmarkRoot()
+	var buf bytes.Buffer
+	NewEncoder(&buf).Encode(articles)
+	data := buf.Bytes()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for it := 0; it < b.N; it++ {
+		var decoded []TestArticle
+		NewDecoder(bytes.NewReader(data)).Decode(&decoded)
+	}
+}
+
+func TestNegotiator(t *testing.T) {
+	n := NewNegotiator()
+	n.Extensions = []string{"https://jsonapi.org/ext/atomic"}
+	n.Profiles = []string{"https://example.com/profile"}
+	var negotiated *MediaTypeParams
+	handler := n.Handler(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			negotiated = NegotiatedMediaType(r.Context())
+			w.WriteHeader(http.StatusNoContent)
+		}))
+
+	tests := []struct {
+		contentType string
+		accept      string
+		status      int
+		response    string
+	}{
+		{"", "", http.StatusNoContent, MediaType},
+		{MediaType, "*/*", http.StatusNoContent, MediaType},
+		{MediaType + "; charset=utf-8", "", http.StatusUnsupportedMediaType, ""},
+		{"application/json", "", http.StatusUnsupportedMediaType, ""},
+		{MediaType + `; ext="https://example.com/unknown"`, "",
+			http.StatusUnsupportedMediaType, ""},
+		{MediaType + `; ext="https://jsonapi.org/ext/atomic"`, "",
+			http.StatusNoContent, MediaType},
+		{"", MediaType + "; charset=utf-8", http.StatusNotAcceptable, ""},
+		{"", "text/html, " + MediaType + ";q=0", http.StatusNotAcceptable, ""},
+		{"", MediaType + "; charset=utf-8, " + MediaType + ";q=0.5",
+			http.StatusNoContent, MediaType},
+		{"", MediaType + `; ext="https://jsonapi.org/ext/atomic"; ` +
+			`profile="https://example.com/profile https://example.com/other"`,
+			http.StatusNoContent, MediaType + `; ext="https://jsonapi.org/ext/atomic"; ` +
+				`profile="https://example.com/profile"`},
+	}
+	for _, test := range tests {
+		negotiated = nil
+		r := httptest.NewRequest(http.MethodGet, "/articles", nil)
+		if test.contentType != "" {
+			r.Header.Set("Content-Type", test.contentType)
+		}
+		if test.accept != "" {
+			r.Header.Set("Accept", test.accept)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.status {
+			t.Errorf("Unexpected status for %q, %q: %d", test.contentType,
+				test.accept, w.Code)
+			continue
+		}
+		if test.status != http.StatusNoContent {
+			root := new(Root)
+			if err := json.Unmarshal(w.Body.Bytes(), root); err != nil ||
+				len(root.Errors) != 1 || root.Errors[0].Source == nil ||
+				root.Errors[0].Status != strconv.Itoa(test.status) {
+				t.Errorf("Unexpected error document: %s", w.Body.Bytes())
+			}
+			continue
+		}
+		if w.Header().Get("Content-Type") != test.response ||
+			negotiated == nil || negotiated.String() != test.response {
+			t.Errorf("Unexpected media type for %q, %q: %s", test.contentType,
+				test.accept, w.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestWriteErrors(t *testing.T) {
+	notFound := NewError()
+	notFound.Status = "404"
+	conflict := &DecodeError{Pointer: "/data/type", Err: ErrDecodingInvalidIDType}
+
+	tests := []struct {
+		errs     []error
+		status   int
+		statuses []string
+	}{
+		{[]error{notFound}, http.StatusNotFound, []string{"404"}},
+		{[]error{notFound, conflict}, http.StatusBadRequest,
+			[]string{"404", "409"}},
+		{[]error{notFound, errors.New("boom")}, http.StatusInternalServerError,
+			[]string{"404", "500"}},
+		{[]error{fmt.Errorf("reading: %w", context.DeadlineExceeded)},
+			http.StatusGatewayTimeout, []string{"504"}},
+		{[]error{fmt.Errorf("decoding: %w", conflict)}, http.StatusConflict,
+			[]string{"409"}},
+		{[]error{ErrorList{ErrDecodingNoData, ErrResourcesBadType}},
+			http.StatusBadRequest, []string{"400", "400"}},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		if err := WriteErrors(w, test.errs...); err != nil {
+			t.Fatal("Error while writing errors:", err)
+		}
+		if w.Code != test.status ||
+			w.Header().Get("Content-Type") != MediaType {
+			t.Errorf("Unexpected response for %v: %d %s", test.errs, w.Code,
+				w.Header().Get("Content-Type"))
+		}
+		root := new(Root)
+		json.Unmarshal(w.Body.Bytes(), root)
+		statuses := make([]string, len(root.Errors))
+		for it, err := range root.Errors {
+			statuses[it] = err.Status
+		}
+		if !reflect.DeepEqual(statuses, test.statuses) {
+			t.Errorf("Unexpected error statuses: %v", statuses)
+		}
+	}
+
+	w := httptest.NewRecorder()
+	WriteErrors(w, errors.New("dial tcp 10.0.0.1:5432: connection refused"),
+		ErrDecodingNoData)
+	root := new(Root)
+	json.Unmarshal(w.Body.Bytes(), root)
+	if len(root.Errors) != 2 || root.Errors[0].Detail != "" ||
+		root.Errors[1].Detail != ErrDecodingNoData.Error() {
+		t.Errorf("Unexpected error details: %s", w.Body.Bytes())
+	}
+
+	w = httptest.NewRecorder()
+	if err := WriteData(w, http.StatusCreated, basicTestStruct); err != nil {
+		t.Fatal("Error while writing data:", err)
+	}
+	expected, _ := Marshal(basicTestStruct)
+	expectedJSON, _ := json.Marshal(expected)
+	if w.Code != http.StatusCreated || !jsonEqual(t, expectedJSON, w.Body.Bytes()) {
+		t.Errorf("Unexpected data response: %d %s", w.Code, w.Body.Bytes())
+	}
+}
+
+func TestDecodeRequest(t *testing.T) {
+	newRequest := func(contentType, body string) *http.Request {
+		r := httptest.NewRequest(http.MethodPost, "/people",
+			strings.NewReader(body))
+		if contentType != "" {
+			r.Header.Set("Content-Type", contentType)
+		}
+		return r
+	}
+
+	var person TestPerson
+	err := DecodeRequest(newRequest(MediaType,
+		`{"data":{"type":"people","attributes":{"name":"Eve"}}}`), &person)
+	if err != nil || person.ID != 0 || person.Name != "Eve" {
+		t.Errorf("Request without id not decoded: %+v, %v", person, err)
+	}
+
+	c := NewContext()
+	c.Strict = true
+	c.MaxBodySize = 96
+	var people []TestPerson
+	err = c.DecodeRequest(newRequest(MediaType,
+		`{"data":[{"type":"people","id":"1"},{"type":"articles","id":"2"}]}`),
+		&people)
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Pointer != "/data/1/type" ||
+		!errors.Is(err, ErrDecodingInvalidIDType) {
+		t.Errorf("Mismatching type not reported: %v", err)
+	}
+
+	tests := []struct {
+		contentType string
+		body        string
+		status      int
+	}{
+		{"", `{"data":null}`, http.StatusUnsupportedMediaType},
+		{"application/json", `{"data":null}`, http.StatusUnsupportedMediaType},
+		{MediaType + "; charset=utf-8", `{}`, http.StatusUnsupportedMediaType},
+		{MediaType, ``, http.StatusBadRequest},
+		{MediaType, `{"data":null}`, http.StatusBadRequest},
+		{MediaType, `{"meta":{}}`, http.StatusBadRequest},
+		{MediaType, `[]`, http.StatusBadRequest},
+		{MediaType, `{"data":{"type":"people"`, http.StatusBadRequest},
+		{MediaType, `{"data":{"type":"people","id":"1","attributes":` +
+			`{"name":"` + strings.Repeat("a", 96) + `"}}}`,
+			http.StatusRequestEntityTooLarge},
+		{MediaType, `{"data":{"type":"articles","id":"1"}}`,
+			http.StatusConflict},
+		{MediaType, `{"data":{"type":"people","id":"1","attributes":` +
+			`{"age":3}}}`, http.StatusUnprocessableEntity},
+	}
+	for _, test := range tests {
+		err := c.DecodeRequest(newRequest(test.contentType, test.body),
+			&person)
+		if err == nil {
+			t.Errorf("No error for %q", test.body)
+			continue
+		}
+		w := httptest.NewRecorder()
+		WriteErrors(w, err)
+		if w.Code != test.status {
+			t.Errorf("Unexpected status for %q, %q: %d (%v)",
+				test.contentType, test.body, w.Code, err)
+		}
+	}
+
+	var numbers TestNumbers
+	body := `{"data":{"type":"numbers","id":"1","attributes":` +
+		`{"big":9007199254740993}}}`
+	c = NewContext()
+	c.UseNumber = true
+	err = c.DecodeRequest(newRequest(MediaType, body), &numbers)
+	if err != nil || numbers.Big != 9007199254740993 {
+		t.Errorf("Large number not decoded exactly: %d, %v", numbers.Big, err)
+	}
+}
+
+func TestFieldsets(t *testing.T) {
+	query, _ := url.ParseQuery("fields[articles]=title,author&fields[people]=" +
+		"&fields[comments]=body&include=author")
+	fieldsets, err := ParseFieldsets(query)
+	if err != nil {
+		t.Fatal("Error while parsing fieldsets:", err)
+	}
+	expected := Fieldsets{
+		"articles": {"title", "author"},
+		"people":   {},
+		"comments": {"body"},
+	}
+	if !reflect.DeepEqual(fieldsets, expected) {
+		t.Errorf("Unexpected fieldsets: %v", fieldsets)
+	}
+	for _, raw := range []string{"fields=title", "fields[]=title",
+		"fields[articles]x=title"} {
+		query, _ := url.ParseQuery(raw)
+		_, err := ParseFieldsets(query)
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) ||
+			!errors.Is(err, ErrInvalidQueryParameter) ||
+			queryErr.JSONAPIError().Source.Parameter == "" {
+			t.Errorf("Invalid parameter not reported for %q: %v", raw, err)
+		}
+	}
+
+	articles := []TestArticle{{ID: 1, Title: "First",
+		Author: &TestPerson{ID: 9, Name: "Dan"},
+		Comments: []TestComment{{ID: 5, Body: "Great",
+			Author: &TestPerson{ID: 2, Name: "Ann"}}}}}
+	c := NewContext()
+	c.Fieldsets = fieldsets
+	root, err := c.Marshal(articles)
+	if err != nil {
+		t.Fatal("Error while marshaling with fieldsets:", err)
+	}
+	article := root.Data.Data[0]
+	if len(article.Attributes) != 1 || article.Attributes["title"] != "First" ||
+		len(article.Relationships) != 1 || article.Relationships["author"] == nil {
+		t.Errorf("Unexpected article members: %+v", article)
+	}
+	if len(root.Included) != 1 || root.Included[0].Type != "people" ||
+		len(root.Included[0].Attributes) != 0 {
+		t.Errorf("Unexpected included resources: %+v", root.Included)
+	}
+
+	expectedJSON, _ := json.Marshal(root)
+	var buf bytes.Buffer
+	if err := c.NewEncoder(&buf).Encode(articles); err != nil {
+		t.Fatal("Error while encoding with fieldsets:", err)
+	}
+	if !jsonEqual(t, expectedJSON, buf.Bytes()) {
+		t.Errorf("Encoded fieldsets do not match:\n%s\n%s", expectedJSON,
+			buf.Bytes())
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	query, _ := url.ParseQuery("include=comments.author,author")
+	includes, err := ParseIncludes(query)
+	if err != nil {
+		t.Fatal("Error while parsing includes:", err)
+	}
+	expected := Includes{
+		"author":   {},
+		"comments": {"author": {}},
+	}
+	if !reflect.DeepEqual(includes, expected) {
+		t.Errorf("Unexpected includes: %v", includes)
+	}
+	if includes.String() != "author,comments.author" {
+		t.Errorf("Unexpected includes string: %s", includes.String())
+	}
+	if err := includes.Validate(new([]TestArticle)); err != nil {
+		t.Error("Valid includes reported as invalid:", err)
+	}
+
+	for _, raw := range []string{"include=author..name", "include=editor",
+		"include=comments.body", "include=author.articles"} {
+		query, _ := url.ParseQuery(raw)
+		includes, err := ParseIncludes(query)
+		if err == nil {
+			err = includes.Validate(TestArticle{})
+		}
+		if !errors.Is(err, ErrInvalidIncludePath) {
+			t.Errorf("Invalid include path not reported for %q: %v", raw, err)
+		}
+	}
+
+	articles := []TestArticle{{ID: 1, Title: "First",
+		Author: &TestPerson{ID: 9, Name: "Dan"},
+		Comments: []TestComment{{ID: 5, Body: "Great",
+			Author: &TestPerson{ID: 2, Name: "Ann"}}}}}
+	tests := []struct {
+		include  string
+		included []string
+	}{
+		{"include=", nil},
+		{"include=author", []string{"people/9"}},
+		{"include=comments", []string{"comments/5"}},
+		{"include=comments.author", []string{"people/2", "comments/5"}},
+		{"", []string{"people/9", "people/2", "comments/5"}},
+	}
+	for _, test := range tests {
+		query, _ := url.ParseQuery(test.include)
+		c := NewContext()
+		c.Include, _ = ParseIncludes(query)
+		root, err := c.Marshal(articles)
+		if err != nil {
+			t.Fatal("Error while marshaling with includes:", err)
+		}
+		var included []string
+		for _, resource := range root.Included {
+			included = append(included, resource.Type+"/"+resource.ID)
+		}
+		if !reflect.DeepEqual(included, test.included) {
+			t.Errorf("Unexpected included resources for %q: %v", test.include,
+				included)
+		}
+		if linkage := root.Data.Data[0].Relationships["author"]; linkage == nil ||
+			linkage.Data.Data[0].ID != "9" {
+			t.Errorf("Linkage missing for %q", test.include)
+		}
+	}
+
+	// A resource included through a short path is marshaled again to follow
+	// a longer one.
+	parent := TestNode{ID: 2, Parent: &TestNode{ID: 3}}
+	node := TestNode{ID: 1, Parent: &parent, Children: []TestNode{parent}}
+	c := NewContext()
+	c.Include = Includes{"parent": {}, "children": {"parent": {}}}
+	root, _ := c.Marshal(node)
+	var included []string
+	for _, resource := range root.Included {
+		included = append(included, resource.ID)
+	}
+	if !reflect.DeepEqual(included, []string{"2", "3"}) {
+		t.Errorf("Unexpected included resources: %v", included)
+	}
+}
+
+func TestQuery(t *testing.T) {
+	values, _ := url.ParseQuery("sort=-title,author.name&page[number]=3" +
+		"&page[size]=20&filter[title]=First&filter[author][name]=Dan" +
+		"&filter[comments][body][like]=great&include=author" +
+		"&fields[people]=name&ext[atomic]=1")
+	q, err := ParseQuery(values)
+	if err != nil {
+		t.Fatal("Error while parsing query:", err)
+	}
+	if !reflect.DeepEqual(q.Sort, []SortField{{"title", true},
+		{"author.name", false}}) || q.Sort[0].String() != "-title" {
+		t.Errorf("Unexpected sort fields: %v", q.Sort)
+	}
+	if q.Page != (Page{Number: 3, Size: 20}) {
+		t.Errorf("Unexpected page: %+v", q.Page)
+	}
+	if q.Filter.Get("title") != "First" ||
+		q.Filter.Get("author", "name") != "Dan" ||
+		q.Filter.Get("comments", "body", "like") != "great" ||
+		q.Filter.Get("author", "missing") != "" {
+		t.Errorf("Unexpected filter: %+v", q.Filter)
+	}
+	if len(q.Include) != 1 || len(q.Fieldsets) != 1 ||
+		!reflect.DeepEqual(q.Other, url.Values{"ext[atomic]": {"1"}}) {
+		t.Errorf("Unexpected query: %+v", q)
+	}
+	if err := q.Validate(new([]TestArticle)); err != nil {
+		t.Error("Valid query reported as invalid:", err)
+	}
+
+	tests := []struct {
+		raw       string
+		parameter string
+		err       error
+	}{
+		{"sort=title,,body", "sort", ErrInvalidQueryParameter},
+		{"page[number]=two", "page[number]", ErrInvalidQueryParameter},
+		{"page[size]=-1", "page[size]", ErrInvalidQueryParameter},
+		{"page[first]=1", "page[first]", ErrInvalidQueryParameter},
+		{"filter[]=1", "filter[]", ErrInvalidQueryParameter},
+		{"sort=-body", "sort", ErrUnknownQueryField},
+		{"sort=author.title", "sort", ErrUnknownQueryField},
+		{"filter[body]=x", "filter[body]", ErrUnknownQueryField},
+		{"filter[author][title]=x", "filter[author][title]",
+			ErrUnknownQueryField},
+		{"include=editor", "include", ErrInvalidIncludePath},
+	}
+	for _, test := range tests {
+		values, _ := url.ParseQuery(test.raw)
+		q, err := ParseQuery(values)
+		if err == nil {
+			err = q.Validate(TestArticle{})
+		}
+		var queryErr *QueryError
+		if !errors.As(err, &queryErr) || queryErr.Parameter != test.parameter ||
+			!errors.Is(err, test.err) {
+			t.Errorf("Unexpected error for %q: %v", test.raw, err)
+		}
+	}
+}
+
+func TestPagination(t *testing.T) {
+	u, _ := url.Parse("/articles?sort=title&page[number]=2&page[size]=2")
+	people := []TestPerson{{ID: 1}, {ID: 2}}
+
+	c := NewContext()
+	c.Pagination = NewPagination(u, Page{Number: 2, Size: 2})
+	c.Pagination.SetTotal(5)
+	root, err := c.Marshal(people)
+	if err != nil {
+		t.Fatal("Error while marshaling paginated collection:", err)
+	}
+	expected := Links{
+		LinkSelf:  "/articles?sort=title&page[number]=2&page[size]=2",
+		LinkFirst: "/articles?page%5Bnumber%5D=1&page%5Bsize%5D=2&sort=title",
+		LinkPrev:  "/articles?page%5Bnumber%5D=1&page%5Bsize%5D=2&sort=title",
+		LinkNext:  "/articles?page%5Bnumber%5D=3&page%5Bsize%5D=2&sort=title",
+		LinkLast:  "/articles?page%5Bnumber%5D=3&page%5Bsize%5D=2&sort=title",
+	}
+	if !reflect.DeepEqual(root.Links, expected) || root.Meta["total"] != 5 {
+		t.Errorf("Unexpected pagination: %v %v", root.Links, root.Meta)
+	}
+
+	var buf bytes.Buffer
+	if err := c.NewEncoder(&buf).Encode(people); err != nil {
+		t.Fatal("Error while encoding paginated collection:", err)
+	}
+	expectedJSON, _ := json.Marshal(root)
+	if !jsonEqual(t, expectedJSON, buf.Bytes()) {
+		t.Errorf("Encoded pagination does not match:\n%s", buf.Bytes())
+	}
+
+	total := func(total int) *int { return &total }
+	tests := []struct {
+		pagination *Pagination
+		count      int
+		links      []string
+	}{
+		{&Pagination{URL: u, Page: Page{Offset: 0, Limit: 2}}, 2,
+			[]string{"first", "next", "self"}},
+		{&Pagination{URL: u, Page: Page{Offset: 3, Limit: 2}}, 1,
+			[]string{"first", "prev", "self"}},
+		{&Pagination{URL: u, Page: Page{Offset: 4, Limit: 2}, Total: total(5)},
+			1, []string{"first", "last", "prev", "self"}},
+		{&Pagination{URL: u, Page: Page{Size: 2}, Total: total(0)}, 0,
+			[]string{"first", "last", "self"}},
+		{&Pagination{URL: u, Page: Page{Size: 2}}, 0, []string{"first", "self"}},
+		{&Pagination{URL: u, NextCursor: "abc"}, 2,
+			[]string{"first", "next", "self"}},
+		{&Pagination{URL: u}, 2, []string{"self"}},
+	}
+	for _, test := range tests {
+		links := test.pagination.Links(test.count)
+		if keys := sortedKeys(links); !reflect.DeepEqual(keys, test.links) {
+			t.Errorf("Unexpected links for %+v: %v", test.pagination, links)
+		}
+	}
+	if links := new(Pagination).Links(2); links != nil {
+		t.Error("Pagination without URL should have no links:", links)
+	}
+	root = NewRoot()
+	(&Pagination{Total: total(0), TotalMeta: "total"}).encode(root, 0)
+	if root.Links != nil || root.Meta["total"] != 0 {
+		t.Errorf("Unexpected pagination without URL: %v %v", root.Links,
+			root.Meta)
+	}
+	offset := (&Pagination{URL: u, Page: Page{Offset: 4, Limit: 2},
+		Total: total(5)}).Links(1)
+	if link, _ := offset.GetLink(LinkPrev); !strings.Contains(link,
+		"page%5Boffset%5D=2") {
+		t.Errorf("Unexpected prev link: %s", link)
+	}
+	if link, _ := offset.GetLink(LinkLast); !strings.Contains(link,
+		"page%5Boffset%5D=4") {
+		t.Errorf("Unexpected last link: %s", link)
+	}
+	cursor := (&Pagination{URL: u, Page: Page{Cursor: "xyz"},
+		NextCursor: "abc"}).Links(2)
+	if link, _ := cursor.GetLink(LinkNext); !strings.Contains(link,
+		"page%5Bcursor%5D=abc") {
+		t.Errorf("Unexpected next link: %s", link)
+	}
+
+	root, _ = c.Marshal(people[0])
+	if _, hasNext := root.Links[LinkNext]; hasNext {
+		t.Error("Single resources should not be paginated")
+	}
+}
+
+// testArticleHandler is an in-memory ResourceHandler of articles.
+type testArticleHandler struct {
+	articles map[string]TestArticle
+	nextID   int
+}
+
+func (h *testArticleHandler) FindAll(r *http.Request,
+	q *Query) (interface{}, error) {
+	articles := make([]TestArticle, 0, len(h.articles))
+	for _, id := range sortedKeys(h.articles) {
+		article := h.articles[id]
+		if title := q.Filter.Get("title"); title == "" || title == article.Title {
+			articles = append(articles, article)
+		}
+	}
+	// The whole collection fits in the default page.
+	page := q.Page
+	if page == (Page{}) {
+		page = Page{Number: 1, Size: 10}
+	}
+	total := len(articles)
+	return &Collection{Data: articles, Page: page, Total: &total}, nil
+}
+
+func (h *testArticleHandler) FindOne(r *http.Request, id string,
+	q *Query) (interface{}, error) {
+	article, found := h.articles[id]
+	if !found {
+		return nil, nil
+	}
+	return &article, nil
+}
+
+func (h *testArticleHandler) Create(r *http.Request,
+	v interface{}) (interface{}, error) {
+	article := v.(*TestArticle)
+	h.nextID++
+	article.ID = h.nextID
+	h.articles[strconv.Itoa(article.ID)] = *article
+	return article, nil
+}
+
+func (h *testArticleHandler) Update(r *http.Request, id string,
+	v interface{}) (interface{}, error) {
+	if _, found := h.articles[id]; !found {
+		return nil, ErrResourceNotFound
+	}
+	h.articles[id] = *v.(*TestArticle)
+	return nil, nil
+}
+
+func (h *testArticleHandler) Delete(r *http.Request, id string) error {
+	if _, found := h.articles[id]; !found {
+		return ErrResourceNotFound
+	}
+	delete(h.articles, id)
+	return nil
+}
+
+func (h *testArticleHandler) UpdateRelationship(r *http.Request, id,
+	name string, diff *LinkageDiff) error {
+	article := h.articles[id]
+	comments := make([]TestComment, 0)
+	for _, commentID := range diff.Result.([]int) {
+		comments = append(comments, TestComment{ID: commentID})
+	}
+	article.Comments = comments
+	h.articles[id] = article
+	return nil
+}
+
+func TestRouter(t *testing.T) {
+	handler := &testArticleHandler{articles: make(map[string]TestArticle),
+		nextID: 1}
+	handler.articles["1"] = TestArticle{ID: 1, Title: "First",
+		Author:   &TestPerson{ID: 9, Name: "Dan"},
+		Comments: []TestComment{{ID: 5, Body: "Great"}}}
+	router := NewRouter()
+	router.Prefix = "/api/"
+	if err := router.Register(TestArticle{}, handler); err != nil {
+		t.Fatal("Error while registering handler:", err)
+	}
+	if err := router.Register(0, handler); !errors.Is(err, ErrInvalidModel) {
+		t.Error("Invalid model not reported:", err)
+	}
+
+	serve := func(method, target, body string) (*httptest.ResponseRecorder,
+		*Root) {
+		var reader io.Reader
+		if body != "" {
+			reader = strings.NewReader(body)
+		}
+		r := httptest.NewRequest(method, target, reader)
+		if body != "" {
+			r.Header.Set("Content-Type", MediaType)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		root := new(Root)
+		json.Unmarshal(w.Body.Bytes(), root)
+		return w, root
+	}
+
+	w, root := serve(http.MethodGet, "/api/articles?include=author", "")
+	if w.Code != http.StatusOK || len(root.Data.Data) != 1 ||
+		len(root.Included) != 1 || root.Links[LinkSelf] == nil {
+		t.Errorf("Unexpected collection response: %d %s", w.Code, w.Body)
+	}
+	if last, _ := root.Links.GetLink(LinkLast); !strings.Contains(last,
+		"page%5Bnumber%5D=1") || root.Links[LinkNext] != nil ||
+		root.Meta["total"] != 1.0 {
+		t.Errorf("Unexpected collection pagination: %v %v", root.Links,
+			root.Meta)
+	}
+
+	w, root = serve(http.MethodPost, "/api/articles",
+		`{"data":{"type":"articles","attributes":{"title":"Second"}}}`)
+	if w.Code != http.StatusCreated ||
+		w.Header().Get("Location") != "/api/articles/2" ||
+		root.Data.Data[0].ID != "2" {
+		t.Errorf("Unexpected creation response: %d %v %s", w.Code,
+			w.Header(), w.Body)
+	}
+
+	w, root = serve(http.MethodGet, "/api/articles/2?fields[articles]=title", "")
+	if w.Code != http.StatusOK || root.Data.Data[0].Attributes["title"] != "Second" {
+		t.Errorf("Unexpected resource response: %d %s", w.Code, w.Body)
+	}
+
+	w, _ = serve(http.MethodPatch, "/api/articles/2",
+		`{"data":{"type":"articles","id":"2","attributes":{"title":"Other"}}}`)
+	if w.Code != http.StatusNoContent || handler.articles["2"].Title != "Other" {
+		t.Errorf("Unexpected update response: %d %s", w.Code, w.Body)
+	}
+
+	w, root = serve(http.MethodGet, "/api/articles/1/author", "")
+	if w.Code != http.StatusOK || root.Data.Data[0].Type != "people" ||
+		root.Data.Data[0].Attributes["name"] != "Dan" {
+		t.Errorf("Unexpected related response: %d %s", w.Code, w.Body)
+	}
+	w, root = serve(http.MethodGet, "/api/articles/2/author", "")
+	if w.Code != http.StatusOK || root.Data == nil || !root.Data.isNull() ||
+		!strings.Contains(w.Body.String(), `"data":null`) {
+		t.Errorf("Unexpected empty related response: %d %s", w.Code, w.Body)
+	}
+
+	w, _ = serve(http.MethodGet, "/api/articles/1/relationships/comments", "")
+	relationship := new(Relationship)
+	json.Unmarshal(w.Body.Bytes(), relationship)
+	if w.Code != http.StatusOK || relationship.Data == nil ||
+		len(relationship.Data.Data) != 1 || relationship.Data.Data[0].ID != "5" ||
+		relationship.Links[LinkRelated] != "/api/articles/1/comments" {
+		t.Errorf("Unexpected relationship response: %d %s", w.Code, w.Body)
+	}
+
+	w, _ = serve(http.MethodPatch, "/api/articles/1",
+		`{"data":{"type":"articles","id":"1","attributes":{"title":"New"}}}`)
+	expected := TestArticle{ID: 1, Title: "New",
+		Author:   &TestPerson{ID: 9, Name: "Dan"},
+		Comments: []TestComment{{ID: 5, Body: "Great"}}}
+	if w.Code != http.StatusNoContent ||
+		!reflect.DeepEqual(handler.articles["1"], expected) {
+		t.Errorf("Partial update should keep other members: %d %+v", w.Code,
+			handler.articles["1"])
+	}
+
+	for _, test := range []struct {
+		method string
+		body   string
+		ids    []string
+	}{
+		{http.MethodPost, `{"data":[{"type":"comments","id":"6"},` +
+			`{"type":"comments","id":"5"}]}`, []string{"5", "6"}},
+		{http.MethodDelete, `{"data":[{"type":"comments","id":"5"}]}`,
+			[]string{"6"}},
+		{http.MethodPatch, `{"data":[]}`, []string{}},
+	} {
+		w, _ = serve(test.method, "/api/articles/1/relationships/comments",
+			test.body)
+		relationship := new(Relationship)
+		json.Unmarshal(w.Body.Bytes(), relationship)
+		ids := make([]string, 0)
+		if relationship.Data != nil {
+			for _, identifier := range relationship.Data.Data {
+				ids = append(ids, identifier.ID)
+			}
+		}
+		if w.Code != http.StatusOK || !reflect.DeepEqual(ids, test.ids) {
+			t.Errorf("Unexpected %s relationship response: %d %s",
+				test.method, w.Code, w.Body)
+		}
+	}
+
+	for _, test := range []struct {
+		relationships string
+		expected      TestArticle
+	}{
+		{`{"author":{"data":null},"comments":{"data":[` +
+			`{"type":"comments","id":"7"},{"type":"comments","id":"8"}]}}`,
+			TestArticle{ID: 1, Title: "New",
+				Comments: []TestComment{{ID: 7}, {ID: 8}}}},
+		{`{"comments":{"data":[{"type":"comments","id":"8"}]}}`,
+			TestArticle{ID: 1, Title: "New", Comments: []TestComment{{ID: 8}}}},
+	} {
+		w, _ = serve(http.MethodPatch, "/api/articles/1",
+			`{"data":{"type":"articles","id":"1","relationships":`+
+				test.relationships+`}}`)
+		if w.Code != http.StatusNoContent ||
+			!reflect.DeepEqual(handler.articles["1"], test.expected) {
+			t.Errorf("Relationships not replaced by update: %d %+v", w.Code,
+				handler.articles["1"])
+		}
+	}
+
+	w, _ = serve(http.MethodDelete, "/api/articles/2", "")
+	if w.Code != http.StatusNoContent || len(handler.articles) != 1 {
+		t.Errorf("Unexpected deletion response: %d %s", w.Code, w.Body)
+	}
+
+	tests := []struct {
+		method string
+		target string
+		body   string
+		status int
+	}{
+		{http.MethodGet, "/api/articles/2", "", http.StatusNotFound},
+		{http.MethodDelete, "/api/articles/2", "", http.StatusNotFound},
+		{http.MethodGet, "/api/people", "", http.StatusNotFound},
+		{http.MethodGet, "/articles", "", http.StatusNotFound},
+		{http.MethodGet, "/apiv2/articles", "", http.StatusNotFound},
+		{http.MethodPatch, "/api/articles/2",
+			`{"data":{"type":"articles","id":"2"}}`, http.StatusNotFound},
+		{http.MethodGet, "/api/articles/1/editor", "", http.StatusNotFound},
+		{http.MethodGet, "/api/articles/1/relationships/title", "",
+			http.StatusNotFound},
+		{http.MethodPut, "/api/articles/1", "", http.StatusMethodNotAllowed},
+		{http.MethodGet, "/api/articles?sort=body", "", http.StatusBadRequest},
+		{http.MethodPost, "/api/articles",
+			`{"data":{"type":"people","attributes":{"title":"Third"}}}`,
+			http.StatusConflict},
+		{http.MethodPatch, "/api/articles/1",
+			`{"data":{"type":"articles","id":"3"}}`, http.StatusConflict},
+		{http.MethodPatch, "/api/articles/1/relationships/author",
+			`{"data":null}`, http.StatusMethodNotAllowed},
+		{http.MethodPost, "/api/articles/1/relationships/comments",
+			`{"data":[{"type":"people","id":"3"}]}`, http.StatusConflict},
+		{http.MethodPost, "/api/articles/1/relationships/comments",
+			`{"data":{"type":"comments","id":"3"}}`,
+			http.StatusUnprocessableEntity},
+		{http.MethodPost, "/api/articles/1/relationships/comments",
+			`{"meta":{}}`, http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		w, root := serve(test.method, test.target, test.body)
+		if w.Code != test.status || len(root.Errors) == 0 {
+			t.Errorf("Unexpected response to %s %s: %d %s", test.method,
+				test.target, w.Code, w.Body)
+		}
+	}
+}
+
+func TestLinkage(t *testing.T) {
+	decode := func(body string, ids interface{}) error {
+		r := httptest.NewRequest(http.MethodPatch,
+			"/articles/1/relationships/author", strings.NewReader(body))
+		r.Header.Set("Content-Type", MediaType)
+		return DecodeLinkage(r, TestArticle{}, "author", ids)
+	}
+
+	var author int
+	if err := decode(`{"data":{"type":"people","id":"4"}}`, &author); err != nil ||
+		author != 4 {
+		t.Errorf("To-one linkage not decoded: %d, %v", author, err)
+	}
+	authorPtr := new(int)
+	if err := decode(`{"data":null}`, &authorPtr); err != nil ||
+		authorPtr != nil {
+		t.Errorf("Null linkage not decoded: %v, %v", authorPtr, err)
+	}
+	var authors []int
+	err := decode(`{"data":{"type":"people","id":"4"}}`, &authors)
+	if !errors.Is(err, ErrResourceLinkageBadType) {
+		t.Error("Mismatching linkage not reported:", err)
+	}
+	err = decode(`{"data":{"type":"comments","id":"4"}}`, &author)
+	var decodeErr *DecodeError
+	if !errors.As(err, &decodeErr) || decodeErr.Pointer != "/data/type" {
+		t.Error("Mismatching type not reported:", err)
+	}
+
+	tests := []struct {
+		method                 string
+		added, removed, result []int
+	}{
+		{http.MethodPost, []int{4}, []int{}, []int{1, 2, 3, 4}},
+		{http.MethodDelete, []int{}, []int{2, 3}, []int{1}},
+		{http.MethodPatch, []int{4}, []int{1}, []int{2, 3, 4}},
+	}
+	for _, test := range tests {
+		diff, err := DiffLinkage(test.method, []int{1, 2, 3},
+			[]int{2, 3, 4, 4})
+		if err != nil {
+			t.Fatal("Error while computing diff:", err)
+		}
+		if !reflect.DeepEqual(diff.Added, test.added) ||
+			!reflect.DeepEqual(diff.Removed, test.removed) ||
+			!reflect.DeepEqual(diff.Result, test.result) {
+			t.Errorf("Unexpected %s diff: %+v", test.method, diff)
+		}
+	}
+	if _, err := DiffLinkage(http.MethodGet, []int{}, []int{}); !errors.Is(err,
+		ErrMethodNotAllowed) {
+		t.Error("Unsupported method not reported:", err)
+	}
+}
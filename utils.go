@@ -1,9 +1,11 @@
 package tjsonapi
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"reflect"
+	"sort"
 )
 
 var (
@@ -65,3 +67,38 @@ func isValidJSONValue(value reflect.Value) error {
 	}
 	return ErrInvalidJSONValue
 }
+
+// decodeJSON unmarshals JSON data to v. If useNumber is true, numbers
+// contained in interface values are decoded as json.Number instead of
+// float64.
+func decodeJSON(data []byte, v interface{}, useNumber bool) error {
+	d := json.NewDecoder(bytes.NewReader(data))
+	if useNumber {
+		d.UseNumber()
+	}
+	return d.Decode(v)
+}
+
+// sortedKeys returns the keys of a map with string keys, in increasing order.
+func sortedKeys(m interface{}) []string {
+	v := reflect.ValueOf(m)
+	keys := make([]string, 0, v.Len())
+	for _, key := range v.MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// firstByte returns the first non-whitespace byte of JSON data, which
+// identifies the type of the encoded value, or 0 if there is none.
+func firstByte(data []byte) byte {
+	for _, b := range data {
+		switch b {
+		case ' ', '\t', '\r', '\n':
+			continue
+		}
+		return b
+	}
+	return 0
+}